@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/ssh/terminal"
+	"golang.org/x/xerrors"
+)
+
+// askpassSocketEnv is set for the commands of a detached session to the
+// socket their ssh prompts are sent to. sshcode runs as ssh's askpass program
+// when it's set.
+const askpassSocketEnv = "SSHCODE_ASKPASS_SOCKET"
+
+// askpassSocket is the socket the prompts of a detached session are answered
+// on while it starts, in its local session directory.
+const askpassSocket = "askpass.sock"
+
+// prompter asks the user prompt and returns the answer, which is echoed as
+// it's typed if echo is set.
+type prompter func(prompt string, echo bool) (string, error)
+
+// useAskpass makes ssh send the prompts of commands started from now on, for
+// passwords, passphrases and unknown host keys, to the socket at path. ssh
+// needs a terminal to prompt on otherwise, which detached sessions don't have.
+func useAskpass(path string) error {
+	exe, err := os.Executable()
+	if err != nil {
+		return xerrors.Errorf("failed to find sshcode executable: %w", err)
+	}
+	os.Setenv("SSH_ASKPASS", exe)
+	os.Setenv("SSH_ASKPASS_REQUIRE", "force")
+	os.Setenv(askpassSocketEnv, path)
+	return nil
+}
+
+// serveAskpass answers the prompts sent to the socket at path by runAskpass
+// with prompt, one at a time, until the returned function is called.
+func serveAskpass(path string, prompt prompter) (func(), error) {
+	os.Remove(path)
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, xerrors.Errorf("failed to listen on %v: %w", path, err)
+	}
+
+	var mu sync.Mutex
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				b, err := ioutil.ReadAll(conn)
+				if err != nil {
+					return
+				}
+
+				mu.Lock()
+				answer, err := prompt(string(b), askpassEchoes(string(b)))
+				mu.Unlock()
+				if err != nil {
+					return
+				}
+				// The newline tells runAskpass the prompt was answered.
+				io.WriteString(conn, answer+"\n")
+			}()
+		}
+	}()
+	return func() {
+		l.Close()
+		os.Remove(path)
+	}, nil
+}
+
+// askpassEchoes reports whether the answer to an ssh prompt can be echoed,
+// which is the case for confirmations such as accepting a host key.
+func askpassEchoes(prompt string) bool {
+	return strings.Contains(prompt, "(yes/no")
+}
+
+// runAskpass is what sshcode does when ssh runs it as its askpass program. It
+// sends prompt to the socket at path and writes the answer to out.
+func runAskpass(path, prompt string, out io.Writer) error {
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		return xerrors.Errorf("can't answer %q as the session is running in the background, use keys or an agent", lastLine(prompt))
+	}
+	defer conn.Close()
+
+	_, err = io.WriteString(conn, prompt)
+	if err != nil {
+		return err
+	}
+	if c, ok := conn.(*net.UnixConn); ok {
+		c.CloseWrite()
+	}
+	b, err := ioutil.ReadAll(conn)
+	if err != nil {
+		return err
+	}
+	if !strings.HasSuffix(string(b), "\n") {
+		return xerrors.Errorf("%q wasn't answered", lastLine(prompt))
+	}
+	_, err = out.Write(b)
+	return err
+}
+
+// lastLine returns the last line of an ssh prompt, which asks the question.
+func lastLine(prompt string) string {
+	prompt = strings.TrimSpace(prompt)
+	return prompt[strings.LastIndex(prompt, "\n")+1:]
+}
+
+// terminalPrompt asks on the terminal sshcode was started from.
+func terminalPrompt(prompt string, echo bool) (string, error) {
+	fmt.Fprint(os.Stderr, prompt)
+	fd := int(os.Stdin.Fd())
+	if !echo && terminal.IsTerminal(fd) {
+		b, err := terminal.ReadPassword(fd)
+		fmt.Fprintln(os.Stderr)
+		return string(b), err
+	}
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
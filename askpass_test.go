@@ -0,0 +1,50 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/xerrors"
+)
+
+func TestAskpass(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sshcode-askpass")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, askpassSocket)
+	stop, err := serveAskpass(path, func(prompt string, echo bool) (string, error) {
+		switch {
+		case echo:
+			return "yes", nil
+		case prompt == "dev's password: ":
+			return "hunter2", nil
+		default:
+			return "", xerrors.New("cancelled")
+		}
+	})
+	require.NoError(t, err)
+
+	var out bytes.Buffer
+	require.NoError(t, runAskpass(path, "dev's password: ", &out))
+	require.Equal(t, "hunter2\n", out.String())
+
+	out.Reset()
+	hostKey := "The authenticity of host 'dev' can't be established.\nAre you sure you want to continue connecting (yes/no/[fingerprint])? "
+	require.NoError(t, runAskpass(path, hostKey, &out))
+	require.Equal(t, "yes\n", out.String())
+
+	err = runAskpass(path, "Enter passphrase for key: ", &out)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "wasn't answered")
+
+	// Once the session runs in the background, prompts fail.
+	stop()
+	err = runAskpass(path, hostKey, &out)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), `"Are you sure you want to continue connecting (yes/no/[fingerprint])?"`)
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"fmt"
+	"html/template"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+
+	"golang.org/x/xerrors"
+)
+
+// code-server authentication modes.
+const (
+	authNone     = "none"
+	authPassword = "password"
+)
+
+// codeServerPasswordFile is the name of the file the session's password is
+// handed to code-server through, in the session's remote socket directory.
+const codeServerPasswordFile = "password"
+
+// prepareSocketDir creates the session's remote socket directory, which only
+// the remote user can access. If password isn't empty, it's written to a file
+// in the directory for codeServerCmd to pass to code-server.
+func prepareSocketDir(tr transport, socketDir, password string) error {
+	script := fmt.Sprintf("umask 077 && mkdir -m 0700 %v", socketDir)
+	if password != "" {
+		script += fmt.Sprintf(" && cat > %v/%v", socketDir, codeServerPasswordFile)
+	}
+
+	cmd := tr.command(script)
+	cmd.Stdin = strings.NewReader(password)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return xerrors.Errorf("failed to create %v: %s: %w", socketDir, out, err)
+	}
+	return nil
+}
+
+// codeServerCmd returns the remote command that runs code-server listening
+// as given by the listen flags, usually on the session's socket, and removes
+// the socket directory once it exits, keeping its exit status. code-server's
+// output is appended to logPath as well as printed, so it survives the
+// connection, and logs older than remoteLogMaxDays next to it are removed.
+// The password is passed through the environment rather than the command
+// line, where other users could see it, and its file is removed once read.
+func codeServerCmd(dir, socketDir, listen, logPath, auth string) string {
+	env := ""
+	if auth == authPassword {
+		passwordFile := socketDir + "/" + codeServerPasswordFile
+		env = fmt.Sprintf(`PASSWORD="$(cat %v && rm %v)" `, passwordFile, passwordFile)
+	}
+	// The exit status is passed through a file as the pipe's is tee's.
+	statusFile := socketDir + "/status"
+	logDir := path.Dir(logPath)
+	return fmt.Sprintf("mkdir -p %v; find %v -name \"*.log\" -mtime +%v -exec rm -f {} \\; 2>/dev/null; "+
+		"{ %v%v %v --auth %v %v; echo $? > %v; } 2>&1 | tee -a %v; "+
+		"code=$(cat %v 2>/dev/null || echo 1); rm -rf %v; exit $code",
+		logDir, logDir, remoteLogMaxDays,
+		env, codeServerPath, dir, auth, listen, statusFile, logPath,
+		statusFile, socketDir,
+	)
+}
+
+// loginPage is an HTML page that logs in to code-server by submitting the
+// password to its login form as soon as it's opened.
+var loginPage = template.Must(template.New("login").Parse(`<!DOCTYPE html>
+<html>
+<head><title>sshcode</title></head>
+<body onload="document.forms[0].submit()">
+<form method="POST" action="{{.Action}}">
+<input type="hidden" name="password" value="{{.Password}}">
+<noscript><button type="submit">Log in to code-server</button></noscript>
+</form>
+</body>
+</html>
+`))
+
+// writeLoginPage writes a loginPage for code-server's login form at action to
+// a file only the user can read, and returns its path. Opening the file in a
+// browser leaves the browser with code-server's session cookie, without the
+// password ever being part of a URL.
+func writeLoginPage(action, password string) (string, error) {
+	f, err := ioutil.TempFile("", "sshcode-login-*.html")
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	err = loginPage.Execute(f, struct {
+		Action   string
+		Password string
+	}{action, password})
+	if err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+	return f.Name(), nil
+}
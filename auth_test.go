@@ -0,0 +1,104 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// localTransport runs commands with the local shell, in place of a remote
+// host.
+type localTransport struct {
+	home string
+}
+
+func (l localTransport) command(script string) *exec.Cmd {
+	cmd := exec.Command("sh", "-c", script)
+	cmd.Env = append(os.Environ(), "HOME="+l.home)
+	return cmd
+}
+
+func (localTransport) copyTo(src, dst string) error {
+	return nil
+}
+
+// fakeCodeServer prints its arguments and password, and exits with status 3.
+const fakeCodeServer = `#!/bin/sh
+echo "args: $*"
+echo "password: $PASSWORD"
+exit 3
+`
+
+func TestCodeServerCmd(t *testing.T) {
+	home, err := ioutil.TempDir("", "sshcode-auth")
+	require.NoError(t, err)
+	defer os.RemoveAll(home)
+
+	serverPath := filepath.Join(home, ".cache", "sshcode", "sshcode-server")
+	require.NoError(t, os.MkdirAll(filepath.Dir(serverPath), 0700))
+	require.NoError(t, ioutil.WriteFile(serverPath, []byte(fakeCodeServer), 0755))
+
+	tr := localTransport{home: home}
+	socketDir := filepath.Join(home, "sshcode-abc")
+	require.NoError(t, prepareSocketDir(tr, socketDir, "hunter2"))
+
+	info, err := os.Stat(socketDir)
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0700), info.Mode().Perm())
+	passwordFile := filepath.Join(socketDir, codeServerPasswordFile)
+	info, err = os.Stat(passwordFile)
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0600), info.Mode().Perm())
+
+	// The directory is new for every session.
+	require.Error(t, prepareSocketDir(tr, socketDir, ""))
+
+	logPath := filepath.Join(home, "logs", "abc.log")
+	// Logs from old sessions are removed.
+	oldLog := filepath.Join(home, "logs", "old.log")
+	require.NoError(t, os.MkdirAll(filepath.Dir(oldLog), 0700))
+	require.NoError(t, ioutil.WriteFile(oldLog, nil, 0600))
+	old := time.Now().AddDate(0, 0, -remoteLogMaxDays-1)
+	require.NoError(t, os.Chtimes(oldLog, old, old))
+
+	listen := "--socket " + socketDir + "/" + codeServerSocket
+	cmd := tr.command(codeServerCmd("~/src", socketDir, listen, logPath, authPassword))
+	out, err := cmd.Output()
+	require.Error(t, err)
+	exitErr, ok := err.(*exec.ExitError)
+	require.True(t, ok)
+	require.Equal(t, 3, exitErr.ExitCode())
+
+	require.Equal(t, "args: "+home+"/src --auth password "+listen+"\npassword: hunter2\n", string(out))
+	log, err := ioutil.ReadFile(logPath)
+	require.NoError(t, err)
+	require.Equal(t, string(out), string(log))
+	require.False(t, pathExists(oldLog))
+	// The password isn't left behind, with the rest of the directory.
+	require.False(t, pathExists(socketDir))
+
+	require.NoError(t, prepareSocketDir(tr, socketDir, ""))
+	out, err = tr.command(codeServerCmd("~", socketDir, listen, logPath, authNone)).Output()
+	require.Error(t, err)
+	require.Equal(t, "args: "+home+" --auth none "+listen+"\npassword: \n", string(out))
+}
+
+func TestWriteLoginPage(t *testing.T) {
+	path, err := writeLoginPage("http://127.0.0.1:8080/login?token=abc", `p"w<d>`)
+	require.NoError(t, err)
+	defer os.Remove(path)
+
+	info, err := os.Stat(path)
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0600), info.Mode().Perm())
+
+	b, err := ioutil.ReadFile(path)
+	require.NoError(t, err)
+	require.Contains(t, string(b), `action="http://127.0.0.1:8080/login?token=abc"`)
+	require.Contains(t, string(b), `value="p&#34;w&lt;d&gt;"`)
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"go.coder.com/flog"
+	"golang.org/x/xerrors"
+)
+
+// awsProvider resolves EC2 instances, given as
+// aws:INSTANCE[?OPTIONS] where INSTANCE is an instance ID or Name tag, using
+// the aws CLI. The options are:
+//
+//	user     the user to log in as, guessed from the AMI by default
+//	key      the private key to use, ~/.ssh/KEYNAME.pem by default if it exists
+//	ssm      connect through SSM Session Manager if true
+//	region   the AWS region
+//	profile  the AWS CLI profile
+type awsProvider struct{}
+
+var ec2InstanceID = regexp.MustCompile(`^i-[0-9a-f]+$`)
+
+// ec2Instance is the part of an instance described by the aws CLI that's
+// used.
+type ec2Instance struct {
+	InstanceID       string `json:"InstanceId"`
+	PublicIPAddress  string `json:"PublicIpAddress"`
+	PublicDNSName    string `json:"PublicDnsName"`
+	PrivateIPAddress string `json:"PrivateIpAddress"`
+	KeyName          string `json:"KeyName"`
+	ImageID          string `json:"ImageId"`
+	State            struct {
+		Name string `json:"Name"`
+	} `json:"State"`
+}
+
+// amiUsers maps substrings of AMI names to their default user. Others use
+// ec2-user, like Amazon Linux.
+var amiUsers = []struct {
+	name string
+	user string
+}{
+	{"ubuntu", "ubuntu"},
+	{"debian", "admin"},
+	{"centos", "centos"},
+	{"fedora", "fedora"},
+	{"bitnami", "bitnami"},
+}
+
+func (awsProvider) resolve(addr string) (target, error) {
+	name, rawQuery := addr, ""
+	if i := strings.Index(addr, "?"); i >= 0 {
+		name, rawQuery = addr[:i], addr[i+1:]
+	}
+	opts, err := url.ParseQuery(rawQuery)
+	if err != nil {
+		return target{}, xerrors.Errorf("invalid options: %w", err)
+	}
+	for k := range opts {
+		switch k {
+		case "user", "key", "ssm", "region", "profile":
+		default:
+			return target{}, xerrors.Errorf("unknown option %q", k)
+		}
+	}
+	if name == "" {
+		return target{}, xerrors.New("expected aws:INSTANCE-ID or aws:NAME")
+	}
+
+	var globalArgs []string
+	for _, k := range []string{"region", "profile"} {
+		if v := opts.Get(k); v != "" {
+			if !safeSSHArg.MatchString(v) {
+				return target{}, xerrors.Errorf("invalid characters in %v %q", k, v)
+			}
+			globalArgs = append(globalArgs, "--"+k, v)
+		}
+	}
+
+	inst, err := describeEC2Instance(globalArgs, name)
+	if err != nil {
+		return target{}, err
+	}
+	if inst.State.Name != "running" {
+		return target{}, xerrors.Errorf("instance %v is %v", inst.InstanceID, inst.State.Name)
+	}
+
+	t := target{user: opts.Get("user")}
+	if t.user == "" {
+		t.user = ec2User(globalArgs, inst.ImageID)
+	}
+
+	var flags []string
+	key := opts.Get("key")
+	if key == "" && inst.KeyName != "" {
+		path := filepath.Join(os.Getenv("HOME"), ".ssh", inst.KeyName+".pem")
+		if pathExists(path) {
+			key = path
+		}
+	}
+	if key != "" {
+		flags = append(flags, "-i "+shellQuote(expandPath(key)))
+	}
+
+	ssm, _ := strconv.ParseBool(opts.Get("ssm"))
+	if ssm {
+		// SSM connects to the instance by ID, so it needs no address.
+		t.host = inst.InstanceID
+		proxy := append([]string{"aws"}, globalArgs...)
+		proxy = append(proxy, "ssm", "start-session", "--target", "%h",
+			"--document-name", "AWS-StartSSHSession", "--parameters", "portNumber=%p",
+		)
+		flags = append(flags, fmt.Sprintf(`-o "ProxyCommand=%v"`, strings.Join(proxy, " ")))
+	} else {
+		switch {
+		case inst.PublicIPAddress != "":
+			t.host = inst.PublicIPAddress
+		case inst.PublicDNSName != "":
+			t.host = inst.PublicDNSName
+		default:
+			t.host = inst.PrivateIPAddress
+		}
+		if t.host == "" {
+			return target{}, xerrors.Errorf("instance %v has no address, pass ssm=true to connect through SSM", inst.InstanceID)
+		}
+	}
+	t.sshFlags = strings.Join(flags, " ")
+
+	return t, t.validate()
+}
+
+// describeEC2Instance returns the instance with the given ID or Name tag.
+func describeEC2Instance(globalArgs []string, name string) (ec2Instance, error) {
+	args := append(append([]string(nil), globalArgs...), "ec2", "describe-instances", "--output", "json")
+	if ec2InstanceID.MatchString(name) {
+		args = append(args, "--instance-ids", name)
+	} else {
+		// Terminated instances keep their tags for a while.
+		args = append(args, "--filters", "Name=tag:Name,Values="+name,
+			"Name=instance-state-name,Values=pending,running,stopping,stopped",
+		)
+	}
+
+	out, err := exec.Command("aws", args...).Output()
+	if err != nil {
+		return ec2Instance{}, xerrors.Errorf("failed to describe instance %v: %v: %w", name, commandStderr(err), err)
+	}
+
+	var desc struct {
+		Reservations []struct {
+			Instances []ec2Instance `json:"Instances"`
+		} `json:"Reservations"`
+	}
+	err = json.Unmarshal(out, &desc)
+	if err != nil {
+		return ec2Instance{}, xerrors.Errorf("failed to parse instance description: %w", err)
+	}
+
+	var instances []ec2Instance
+	for _, r := range desc.Reservations {
+		instances = append(instances, r.Instances...)
+	}
+	switch len(instances) {
+	case 0:
+		return ec2Instance{}, xerrors.Errorf("no instance %v found", name)
+	case 1:
+		return instances[0], nil
+	default:
+		ids := make([]string, len(instances))
+		for i, inst := range instances {
+			ids[i] = inst.InstanceID
+		}
+		return ec2Instance{}, xerrors.Errorf("%v matches several instances, use one of their IDs: %v", name, strings.Join(ids, ", "))
+	}
+}
+
+// ec2User guesses the default user of an instance from the name of its AMI.
+func ec2User(globalArgs []string, imageID string) string {
+	const defaultUser = "ec2-user"
+
+	args := append(append([]string(nil), globalArgs...), "ec2", "describe-images", "--output", "json", "--image-ids", imageID)
+	out, err := exec.Command("aws", args...).Output()
+	if err != nil {
+		flog.Info("failed to look up AMI %v, logging in as %v: %v", imageID, defaultUser, commandStderr(err))
+		return defaultUser
+	}
+
+	var desc struct {
+		Images []struct {
+			Name string `json:"Name"`
+		} `json:"Images"`
+	}
+	err = json.Unmarshal(out, &desc)
+	if err != nil || len(desc.Images) == 0 {
+		return defaultUser
+	}
+
+	name := strings.ToLower(desc.Images[0].Name)
+	for _, ami := range amiUsers {
+		if strings.Contains(name, ami.name) {
+			return ami.user
+		}
+	}
+	return defaultUser
+}
+
+// commandStderr returns what a failed command printed to stderr.
+func commandStderr(err error) string {
+	var exitErr *exec.ExitError
+	if xerrors.As(err, &exitErr) {
+		return strings.TrimSpace(string(exitErr.Stderr))
+	}
+	return ""
+}
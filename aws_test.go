@@ -0,0 +1,90 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// fakeAWS answers describe-instances and describe-images with canned JSON
+// and records its arguments.
+const fakeAWS = `#!/bin/sh
+echo "$@" >> "$(dirname "$0")/args"
+case "$*" in
+*describe-images*)
+	echo '{"Images": [{"Name": "ubuntu/images/hvm-ssd/ubuntu-jammy-22.04-amd64-server"}]}'
+	;;
+*"Values=dev"*|*i-0123456789abcdef0*)
+	echo '{"Reservations": [{"Instances": [{"InstanceId": "i-0123456789abcdef0", "PublicIpAddress": "54.1.2.3", "PrivateIpAddress": "10.0.0.5", "KeyName": "team", "ImageId": "ami-1", "State": {"Name": "running"}}]}]}'
+	;;
+*"Values=stopped"*)
+	echo '{"Reservations": [{"Instances": [{"InstanceId": "i-0ff", "State": {"Name": "stopped"}}]}]}'
+	;;
+*"Values=many"*)
+	echo '{"Reservations": [{"Instances": [{"InstanceId": "i-01"}]}, {"Instances": [{"InstanceId": "i-02"}]}]}'
+	;;
+*)
+	echo '{"Reservations": []}'
+	;;
+esac
+`
+
+func TestAWSProvider(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sshcode-aws")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	err = ioutil.WriteFile(filepath.Join(dir, "aws"), []byte(fakeAWS), 0755)
+	require.NoError(t, err)
+	err = os.MkdirAll(filepath.Join(dir, ".ssh"), 0700)
+	require.NoError(t, err)
+	key := filepath.Join(dir, ".ssh", "team.pem")
+	err = ioutil.WriteFile(key, nil, 0600)
+	require.NoError(t, err)
+
+	defer os.Setenv("PATH", os.Getenv("PATH"))
+	os.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+	defer os.Setenv("HOME", os.Getenv("HOME"))
+	os.Setenv("HOME", dir)
+
+	tcs := []struct {
+		host        string
+		destination string
+		flags       string
+		wantErr     string
+	}{
+		{host: "aws:dev", destination: "ubuntu@54.1.2.3", flags: `-i '` + key + `'`},
+		{host: "aws:i-0123456789abcdef0?user=admin&key=/keys/dev", destination: "admin@54.1.2.3", flags: `-i '/keys/dev'`},
+		{host: "aws:dev?key=/keys/it's%20mine%3B%20rm", destination: "ubuntu@54.1.2.3", flags: `-i '/keys/it'\''s mine; rm'`},
+		{
+			host:        "aws:dev?ssm=true&region=eu-west-1",
+			destination: "ubuntu@i-0123456789abcdef0",
+			flags: `-i '` + key + `' -o "ProxyCommand=aws --region eu-west-1 ssm start-session --target %h ` +
+				`--document-name AWS-StartSSHSession --parameters portNumber=%p"`,
+		},
+		{host: "aws:stopped", wantErr: "instance i-0ff is stopped"},
+		{host: "aws:many", wantErr: "use one of their IDs: i-01, i-02"},
+		{host: "aws:missing", wantErr: "no instance missing found"},
+		{host: "aws:dev?color=red", wantErr: `unknown option "color"`},
+	}
+	for _, tc := range tcs {
+		t.Run(tc.host, func(t *testing.T) {
+			target, err := parseHost(tc.host)
+			if tc.wantErr != "" {
+				require.Error(t, err)
+				require.Contains(t, err.Error(), tc.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tc.destination, target.destination())
+			require.Equal(t, tc.flags, target.flags())
+		})
+	}
+
+	args, err := ioutil.ReadFile(filepath.Join(dir, "args"))
+	require.NoError(t, err)
+	require.Contains(t, string(args), "--region eu-west-1 ec2 describe-instances --output json --filters Name=tag:Name,Values=dev")
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"go.coder.com/flog"
+	"golang.org/x/xerrors"
+)
+
+// bastionStartTimeout is how long an Azure Bastion tunnel has to start.
+const bastionStartTimeout = 30 * time.Second
+
+// azureProvider resolves Azure VMs, given as
+// azure:RESOURCE-GROUP/VM[?OPTIONS], using the az CLI. The options are:
+//
+//	user          the user to log in as, the VM's admin user by default
+//	key           the private key to use
+//	bastion       connect through the Azure Bastion host with this name
+//	bastionGroup  the resource group of the bastion, the VM's by default
+//	subscription  the Azure subscription
+type azureProvider struct{}
+
+// azureVM is the part of a VM shown by the az CLI that's used.
+type azureVM struct {
+	ID         string `json:"id"`
+	PowerState string `json:"powerState"`
+	PublicIPs  string `json:"publicIps"`
+	PrivateIPs string `json:"privateIps"`
+	FQDNs      string `json:"fqdns"`
+	OSProfile  struct {
+		AdminUsername string `json:"adminUsername"`
+	} `json:"osProfile"`
+}
+
+func (azureProvider) resolve(addr string) (target, error) {
+	name, rawQuery := addr, ""
+	if i := strings.Index(addr, "?"); i >= 0 {
+		name, rawQuery = addr[:i], addr[i+1:]
+	}
+	opts, err := url.ParseQuery(rawQuery)
+	if err != nil {
+		return target{}, xerrors.Errorf("invalid options: %w", err)
+	}
+	for k := range opts {
+		switch k {
+		case "user", "key", "bastion", "bastionGroup", "subscription":
+		default:
+			return target{}, xerrors.Errorf("unknown option %q", k)
+		}
+	}
+	toks := strings.Split(name, "/")
+	if len(toks) != 2 || toks[0] == "" || toks[1] == "" {
+		return target{}, xerrors.New("expected azure:RESOURCE-GROUP/VM")
+	}
+	group, vmName := toks[0], toks[1]
+	if !safeSSHArg.MatchString(group) || !safeSSHArg.MatchString(vmName) {
+		return target{}, xerrors.Errorf("invalid characters in %q", name)
+	}
+
+	var globalArgs []string
+	if sub := opts.Get("subscription"); sub != "" {
+		globalArgs = append(globalArgs, "--subscription", sub)
+	}
+
+	args := append(append([]string(nil), globalArgs...), "vm", "show", "-d", "-g", group, "-n", vmName, "-o", "json")
+	out, err := exec.Command("az", args...).Output()
+	if err != nil {
+		return target{}, xerrors.Errorf("failed to show VM %v: %v: %w", name, commandStderr(err), err)
+	}
+	var vm azureVM
+	err = json.Unmarshal(out, &vm)
+	if err != nil {
+		return target{}, xerrors.Errorf("failed to parse VM details: %w", err)
+	}
+	if vm.PowerState != "" && vm.PowerState != "VM running" {
+		return target{}, xerrors.Errorf("VM %v is %v", name, strings.TrimPrefix(vm.PowerState, "VM "))
+	}
+
+	t := target{user: opts.Get("user")}
+	if t.user == "" {
+		t.user = vm.OSProfile.AdminUsername
+	}
+
+	var flags []string
+	if key := opts.Get("key"); key != "" {
+		flags = append(flags, "-i "+shellQuote(expandPath(key)))
+	}
+
+	if bastion := opts.Get("bastion"); bastion != "" {
+		bastionGroup := opts.Get("bastionGroup")
+		if bastionGroup == "" {
+			bastionGroup = group
+		}
+		port, err := stablePort("azure bastion "+name, "127.0.0.1")
+		if err != nil {
+			return target{}, xerrors.Errorf("failed to pick a port for the bastion tunnel: %w", err)
+		}
+
+		t.host = "127.0.0.1"
+		t.port = port
+		// The tunnel's address says nothing about the VM, so its host key is
+		// recorded under the VM's name instead.
+		flags = append(flags, fmt.Sprintf(`-o "HostKeyAlias=azure-%v-%v"`, group, vmName))
+		tunnelArgs := append(append([]string(nil), globalArgs...), "network", "bastion", "tunnel",
+			"--name", bastion, "--resource-group", bastionGroup,
+			"--target-resource-id", vm.ID, "--resource-port", "22", "--port", port,
+		)
+		t.hooks = &bastionTunnel{args: tunnelArgs, addr: net.JoinHostPort(t.host, port)}
+	} else {
+		t.host = firstAzureAddr(vm.PublicIPs)
+		if t.host == "" {
+			t.host = firstAzureAddr(vm.FQDNs)
+		}
+		if t.host == "" {
+			t.host = firstAzureAddr(vm.PrivateIPs)
+		}
+		if t.host == "" {
+			return target{}, xerrors.Errorf("VM %v has no address, pass bastion=NAME to connect through Azure Bastion", name)
+		}
+	}
+	t.sshFlags = strings.Join(flags, " ")
+
+	return t, t.validate()
+}
+
+// firstAzureAddr returns the first of the comma separated addresses the az
+// CLI lists.
+func firstAzureAddr(addrs string) string {
+	return strings.TrimSpace(strings.Split(addrs, ",")[0])
+}
+
+// bastionTunnel runs an Azure Bastion tunnel to the VM for the session.
+// az can't tunnel over stdin and stdout, so it can't be used as a
+// ProxyCommand.
+type bastionTunnel struct {
+	args []string
+	addr string
+	cmd  *exec.Cmd
+}
+
+func (b *bastionTunnel) start() error {
+	flog.Info("starting Azure Bastion tunnel on %v", b.addr)
+	b.cmd = exec.Command("az", b.args...)
+	b.cmd.Stdout = os.Stderr
+	b.cmd.Stderr = os.Stderr
+	// az is a wrapper script on most systems, so killing it alone would leave
+	// the tunnel running.
+	b.cmd.SysProcAttr = groupSysProcAttr()
+	err := b.cmd.Start()
+	if err != nil {
+		return xerrors.Errorf("failed to start Azure Bastion tunnel: %w", err)
+	}
+	exited := make(chan error, 1)
+	go func() {
+		exited <- b.cmd.Wait()
+	}()
+	// The session's stop hook only runs once start returns, so the tunnel
+	// is stopped here if sshcode is signalled while it starts.
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(sigs)
+
+	deadline := time.Now().Add(bastionStartTimeout)
+	for time.Now().Before(deadline) {
+		select {
+		case err := <-exited:
+			// az may have left the tunnel itself running.
+			killGroup(b.cmd.Process)
+			return xerrors.Errorf("Azure Bastion tunnel exited: %w", err)
+		case sig := <-sigs:
+			killGroup(b.cmd.Process)
+			return xerrors.Errorf("received %v while starting Azure Bastion tunnel", sig)
+		default:
+		}
+		conn, err := net.DialTimeout("tcp", b.addr, time.Second)
+		if err == nil {
+			conn.Close()
+			return nil
+		}
+		time.Sleep(200 * time.Millisecond)
+	}
+	killGroup(b.cmd.Process)
+	return xerrors.Errorf("Azure Bastion tunnel didn't start listening within %v", bastionStartTimeout)
+}
+
+func (b *bastionTunnel) stop() error {
+	if b.cmd == nil || b.cmd.Process == nil {
+		return nil
+	}
+	// The tunnel may have exited already, which ssh will have reported.
+	killGroup(b.cmd.Process)
+	return nil
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// fakeAz answers vm show with canned JSON and records its arguments.
+const fakeAz = `#!/bin/sh
+echo "$@" >> "$(dirname "$0")/args"
+case "$*" in
+*"-n web "*)
+	echo '{"id": "/subscriptions/s/resourceGroups/rg/providers/Microsoft.Compute/virtualMachines/web", "powerState": "VM running", "publicIps": "20.1.2.3", "privateIps": "10.1.0.4", "fqdns": "", "osProfile": {"adminUsername": "azureuser"}}'
+	;;
+*"-n private "*)
+	echo '{"id": "/subscriptions/s/resourceGroups/rg/providers/Microsoft.Compute/virtualMachines/private", "powerState": "VM running", "publicIps": "", "privateIps": "10.1.0.5,10.1.0.6", "fqdns": "", "osProfile": {"adminUsername": "azureuser"}}'
+	;;
+*"-n stopped "*)
+	echo '{"id": "x", "powerState": "VM deallocated", "osProfile": {"adminUsername": "azureuser"}}'
+	;;
+*)
+	echo "ERROR: The Resource 'Microsoft.Compute/virtualMachines/missing' was not found." >&2
+	exit 3
+	;;
+esac
+`
+
+func TestAzureProvider(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sshcode-azure")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	err = ioutil.WriteFile(filepath.Join(dir, "az"), []byte(fakeAz), 0755)
+	require.NoError(t, err)
+
+	defer os.Setenv("PATH", os.Getenv("PATH"))
+	os.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+	defer os.Setenv("XDG_STATE_HOME", os.Getenv("XDG_STATE_HOME"))
+	os.Setenv("XDG_STATE_HOME", dir)
+
+	tcs := []struct {
+		host        string
+		destination string
+		flags       string
+		wantErr     string
+	}{
+		{host: "azure:rg/web", destination: "azureuser@20.1.2.3"},
+		{host: "azure:rg/web?user=dev&key=/keys/web&subscription=s", destination: "dev@20.1.2.3", flags: `-i '/keys/web'`},
+		{host: "azure:rg/web?key=/keys/a%22$(rm)%22", destination: "azureuser@20.1.2.3", flags: `-i '/keys/a"$(rm)"'`},
+		{host: "azure:rg/private", destination: "azureuser@10.1.0.5"},
+		{host: "azure:rg/stopped", wantErr: "VM rg/stopped is deallocated"},
+		{host: "azure:rg/missing", wantErr: "was not found"},
+		{host: "azure:web", wantErr: "expected azure:RESOURCE-GROUP/VM"},
+		{host: "azure:rg/web?color=red", wantErr: `unknown option "color"`},
+	}
+	for _, tc := range tcs {
+		t.Run(tc.host, func(t *testing.T) {
+			target, err := parseHost(tc.host)
+			if tc.wantErr != "" {
+				require.Error(t, err)
+				require.Contains(t, err.Error(), tc.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tc.destination, target.destination())
+			require.Equal(t, tc.flags, target.flags())
+			require.Nil(t, target.hooks)
+		})
+	}
+
+	args, err := ioutil.ReadFile(filepath.Join(dir, "args"))
+	require.NoError(t, err)
+	require.Contains(t, string(args), "--subscription s vm show -d -g rg -n web -o json")
+
+	t.Run("bastion", func(t *testing.T) {
+		target, err := parseHost("azure:rg/private?bastion=hub&bastionGroup=net")
+		require.NoError(t, err)
+		require.Equal(t, "azureuser@127.0.0.1", target.destination())
+		require.Equal(t, "-p "+target.port+` -o "HostKeyAlias=azure-rg-private"`, target.flags())
+
+		tunnel, ok := target.hooks.(*bastionTunnel)
+		require.True(t, ok)
+		require.Equal(t, []string{
+			"network", "bastion", "tunnel", "--name", "hub", "--resource-group", "net",
+			"--target-resource-id", "/subscriptions/s/resourceGroups/rg/providers/Microsoft.Compute/virtualMachines/private",
+			"--resource-port", "22", "--port", target.port,
+		}, tunnel.args)
+
+		// The tunnel keeps its port across sessions.
+		again, err := parseHost("azure:rg/private?bastion=hub")
+		require.NoError(t, err)
+		require.Equal(t, target.port, again.port)
+	})
+}
+
+// fakeBastionAz stands in for az network bastion tunnel, which is a wrapper
+// script around the process holding the tunnel open. It records that
+// process's PID, and exits without waiting for it if asked to.
+const fakeBastionAz = `#!/bin/sh
+sleep 60 &
+echo $! > "$(dirname "$0")/tunnel.pid"
+[ "$1" = exit ] && exit 1
+wait
+`
+
+func TestBastionTunnel(t *testing.T) {
+	if _, err := os.Stat("/proc/self/stat"); err != nil {
+		t.Skip("needs /proc")
+	}
+
+	dir, err := ioutil.TempDir("", "sshcode-bastion")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	err = ioutil.WriteFile(filepath.Join(dir, "az"), []byte(fakeBastionAz), 0755)
+	require.NoError(t, err)
+
+	defer os.Setenv("PATH", os.Getenv("PATH"))
+	os.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	// The test listens in place of the tunnel.
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+
+	tunnelPID := func() int {
+		var pid int
+		for deadline := time.Now().Add(5 * time.Second); pid == 0 && time.Now().Before(deadline); {
+			b, err := ioutil.ReadFile(filepath.Join(dir, "tunnel.pid"))
+			if err == nil {
+				pid, _ = strconv.Atoi(strings.TrimSpace(string(b)))
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		require.NotZero(t, pid)
+		os.Remove(filepath.Join(dir, "tunnel.pid"))
+		return pid
+	}
+	// The process may be left as a zombie if nothing reaps orphans.
+	stopped := func(pid int) bool {
+		for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+			stat, err := ioutil.ReadFile(fmt.Sprintf("/proc/%v/stat", pid))
+			if err != nil || strings.Contains(string(stat), ") Z ") {
+				return true
+			}
+		}
+		return false
+	}
+
+	b := &bastionTunnel{addr: l.Addr().String()}
+	require.NoError(t, b.start())
+	pid := tunnelPID()
+	require.NoError(t, b.stop())
+	require.True(t, stopped(pid), "tunnel is still running")
+
+	// The tunnel is stopped if az exits while it starts.
+	b = &bastionTunnel{args: []string{"exit"}, addr: "127.0.0.1:1"}
+	require.Error(t, b.start())
+	require.True(t, stopped(tunnelPID()), "tunnel is still running")
+}
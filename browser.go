@@ -0,0 +1,224 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	"github.com/pkg/browser"
+	"go.coder.com/flog"
+	"golang.org/x/xerrors"
+)
+
+// Browser names that aren't in browserApps.
+const (
+	browserAuto   = "auto"
+	browserSystem = "system"
+	browserNone   = "none"
+)
+
+// browserURLPlaceholder is replaced with the URL in custom browser commands.
+const browserURLPlaceholder = "{url}"
+
+// browserApp is a browser sshcode knows how to launch.
+type browserApp struct {
+	name string
+	// commands are the executables or absolute paths tried in order.
+	commands []string
+	// chromium is set for browsers that take Chromium's flags, which can open
+	// the editor as an app window. The rest take Firefox's.
+	chromium bool
+}
+
+var browserApps = []browserApp{
+	{
+		name: "chrome",
+		commands: []string{
+			"chrome",
+			"google-chrome",
+			"google-chrome-stable",
+			"/Applications/Google Chrome.app/Contents/MacOS/Google Chrome",
+			"/mnt/c/Program Files (x86)/Google/Chrome/Application/chrome.exe",
+			"C:/Program Files (x86)/Google/Chrome/Application/chrome.exe",
+		},
+		chromium: true,
+	},
+	{
+		name: "chromium",
+		commands: []string{
+			"chromium",
+			"chromium-browser",
+			"/Applications/Chromium.app/Contents/MacOS/Chromium",
+		},
+		chromium: true,
+	},
+	{
+		name: "edge",
+		commands: []string{
+			"microsoft-edge",
+			"microsoft-edge-stable",
+			"/Applications/Microsoft Edge.app/Contents/MacOS/Microsoft Edge",
+			"/mnt/c/Program Files (x86)/Microsoft/Edge/Application/msedge.exe",
+			"C:/Program Files (x86)/Microsoft/Edge/Application/msedge.exe",
+		},
+		chromium: true,
+	},
+	{
+		name: "firefox",
+		commands: []string{
+			"firefox",
+			"/Applications/Firefox.app/Contents/MacOS/firefox",
+			"C:/Program Files/Mozilla Firefox/firefox.exe",
+		},
+	},
+}
+
+// browserNames returns the names accepted by --browser, other than custom
+// commands.
+func browserNames() []string {
+	names := []string{browserAuto}
+	for _, app := range browserApps {
+		names = append(names, app.name)
+	}
+	return append(names, browserSystem, browserNone)
+}
+
+// browserConfig describes how the editor is opened.
+type browserConfig struct {
+	// name is one of browserNames, or a command containing
+	// browserURLPlaceholder. Empty means browserAuto.
+	name string
+	// flags are passed to the browser in addition to sshcode's.
+	flags []string
+	// noAppMode opens a regular window instead of an app window.
+	noAppMode bool
+	// profileDir is the browser profile used. It defaults to a directory in
+	// the state directory, so logins and zoom levels survive sessions.
+	profileDir string
+}
+
+// validate checks that name is a known browser or a custom command.
+func (c browserConfig) validate() error {
+	if c.name == "" || strings.Contains(c.name, browserURLPlaceholder) {
+		return nil
+	}
+	for _, name := range browserNames() {
+		if c.name == name {
+			return nil
+		}
+	}
+	return xerrors.Errorf("unknown browser %q, expected one of %v or a command containing %v",
+		c.name, strings.Join(browserNames(), ", "), browserURLPlaceholder,
+	)
+}
+
+// open opens url in the configured browser.
+func (c browserConfig) open(url string) error {
+	switch c.name {
+	case "", browserAuto:
+		for _, name := range []string{"chrome", "chromium"} {
+			app, _ := findBrowserApp(name)
+			if cmd, ok := app.find(); ok {
+				return c.launch(app, cmd, url)
+			}
+		}
+		return browser.OpenURL(url)
+	case browserSystem:
+		return browser.OpenURL(url)
+	case browserNone:
+		flog.Info("open %v in your browser", url)
+		return nil
+	}
+
+	if strings.Contains(c.name, browserURLPlaceholder) {
+		args := customBrowserArgs(c.name, url)
+		return exec.Command(args[0], args[1:]...).Start()
+	}
+
+	app, ok := findBrowserApp(c.name)
+	if !ok {
+		return c.validate()
+	}
+	cmd, ok := app.find()
+	if !ok {
+		return xerrors.Errorf("%v isn't installed", app.name)
+	}
+	return c.launch(app, cmd, url)
+}
+
+// launch starts cmd to open url. It isn't waited for, as the command may
+// become the browser's main process if it isn't already running.
+func (c browserConfig) launch(app browserApp, cmd, url string) error {
+	profileDir := c.profileDir
+	if profileDir == "" {
+		profileDir = filepath.Join(stateDir(), "browser", app.name)
+	}
+	// Windows browsers launched from WSL can't use a Linux path.
+	if runtime.GOOS != "windows" && strings.HasSuffix(cmd, ".exe") {
+		profileDir = ""
+	}
+	if profileDir != "" {
+		err := os.MkdirAll(profileDir, 0700)
+		if err != nil {
+			return xerrors.Errorf("failed to create browser profile: %w", err)
+		}
+	}
+
+	return exec.Command(cmd, app.args(url, profileDir, c)...).Start()
+}
+
+func findBrowserApp(name string) (browserApp, bool) {
+	for _, app := range browserApps {
+		if app.name == name {
+			return app, true
+		}
+	}
+	return browserApp{}, false
+}
+
+// find returns the first of the browser's commands that exists.
+func (b browserApp) find() (string, bool) {
+	for _, cmd := range b.commands {
+		if strings.Contains(cmd, "/") {
+			if pathExists(cmd) {
+				return cmd, true
+			}
+		} else if commandExists(cmd) {
+			return cmd, true
+		}
+	}
+	return "", false
+}
+
+// args returns the arguments that open url with the given profile.
+func (b browserApp) args(url, profileDir string, c browserConfig) []string {
+	var args []string
+	if b.chromium {
+		if profileDir != "" {
+			args = append(args, "--user-data-dir="+profileDir, "--no-first-run", "--no-default-browser-check")
+		}
+		args = append(args, c.flags...)
+		if c.noAppMode {
+			return append(args, url)
+		}
+		return append(args, "--app="+url)
+	}
+
+	if profileDir != "" {
+		args = append(args, "--profile", profileDir)
+	}
+	args = append(args, c.flags...)
+	return append(args, "--new-window", url)
+}
+
+// customBrowserArgs splits a custom browser command into arguments and
+// substitutes url.
+func customBrowserArgs(command, url string) []string {
+	args := strings.Fields(command)
+	for i, arg := range args {
+		args[i] = strings.Replace(arg, browserURLPlaceholder, url, -1)
+	}
+	return args
+}
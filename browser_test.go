@@ -0,0 +1,57 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestBrowserConfig(t *testing.T) {
+	for _, name := range []string{"", "auto", "chrome", "firefox", "none", "open -a Safari {url}"} {
+		require.NoError(t, browserConfig{name: name}.validate(), name)
+	}
+	require.Error(t, browserConfig{name: "safari"}.validate())
+
+	chrome, ok := findBrowserApp("chrome")
+	require.True(t, ok)
+	firefox, ok := findBrowserApp("firefox")
+	require.True(t, ok)
+
+	const url = "http://127.0.0.1:20000/"
+	tcs := []struct {
+		name    string
+		app     browserApp
+		profile string
+		config  browserConfig
+		want    []string
+	}{
+		{
+			name:    "chrome",
+			app:     chrome,
+			profile: "/state/browser/chrome",
+			want:    []string{"--user-data-dir=/state/browser/chrome", "--no-first-run", "--no-default-browser-check", "--app=" + url},
+		},
+		{
+			name:   "chrome window with flags",
+			app:    chrome,
+			config: browserConfig{flags: []string{"--incognito"}, noAppMode: true},
+			want:   []string{"--incognito", url},
+		},
+		{
+			name:    "firefox",
+			app:     firefox,
+			profile: "/state/browser/firefox",
+			want:    []string{"--profile", "/state/browser/firefox", "--new-window", url},
+		},
+	}
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			require.Equal(t, tc.want, tc.app.args(url, tc.profile, tc.config))
+		})
+	}
+
+	require.Equal(t,
+		[]string{"open", "-a", "Safari", url},
+		customBrowserArgs("open -a Safari {url}", url),
+	)
+}
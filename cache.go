@@ -0,0 +1,303 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"go.coder.com/flog"
+	"golang.org/x/xerrors"
+)
+
+// cacheableExts are the extensions of the static assets that are cached.
+// They're served from the code-server binary, so they don't change as long as
+// its version doesn't.
+var cacheableExts = map[string]bool{
+	".js":    true,
+	".css":   true,
+	".html":  true,
+	".svg":   true,
+	".png":   true,
+	".jpg":   true,
+	".gif":   true,
+	".ico":   true,
+	".woff":  true,
+	".woff2": true,
+	".ttf":   true,
+	".wasm":  true,
+	".map":   true,
+}
+
+// assetCacheDir returns the directory static assets of the given code-server
+// version are cached in.
+func assetCacheDir(version string) string {
+	return filepath.Join(stateDir(), "cache", version)
+}
+
+var unsafeVersionChars = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+
+// codeServerVersion returns the version of the code-server binary on the
+// target in a form that can be used in a path.
+func codeServerVersion(tr transport) (string, error) {
+	out, err := tr.command(codeServerPath + " --version").Output()
+	if err != nil {
+		return "", xerrors.Errorf("failed to get code-server version: %w", err)
+	}
+	version := strings.TrimSpace(strings.SplitN(string(out), "\n", 2)[0])
+	version = unsafeVersionChars.ReplaceAllString(version, "_")
+	if version == "" || strings.Trim(version, ".") == "" {
+		return "", xerrors.Errorf("unexpected code-server version %q", out)
+	}
+	return version, nil
+}
+
+// assetCache serves static assets from a disk cache, and caches those
+// that aren't yet after fetching them from next.
+type assetCache struct {
+	next http.Handler
+	dir  string
+}
+
+// cachedAsset is the metadata stored alongside a cached asset.
+type cachedAsset struct {
+	ContentType string `json:"contentType"`
+}
+
+// cacheable reports whether the response to r can be cached. Only plain GETs
+// of static files are, as anything with a query may be read from the remote
+// filesystem.
+func cacheable(r *http.Request) bool {
+	if r.Method != http.MethodGet || r.URL.RawQuery != "" || isWebSocketUpgrade(r) {
+		return false
+	}
+	if r.Header.Get("Range") != "" {
+		return false
+	}
+	p := strings.ToLower(r.URL.Path)
+	if strings.Contains(p, "resource") {
+		return false
+	}
+	return cacheableExts[path.Ext(p)]
+}
+
+func (c *assetCache) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !cacheable(r) {
+		c.next.ServeHTTP(w, r)
+		return
+	}
+
+	sum := sha256.Sum256([]byte(r.URL.Path))
+	key := filepath.Join(c.dir, hex.EncodeToString(sum[:]))
+
+	if c.serveCached(w, key) {
+		return
+	}
+
+	rec := &recordingWriter{ResponseWriter: w}
+	c.next.ServeHTTP(rec, r)
+	if rec.status != http.StatusOK || !rec.cacheable() {
+		return
+	}
+
+	err := c.store(key, rec)
+	if err != nil {
+		flog.Error("failed to cache %v: %v", r.URL.Path, err)
+	}
+}
+
+func (c *assetCache) serveCached(w http.ResponseWriter, key string) bool {
+	metaBytes, err := ioutil.ReadFile(key + ".json")
+	if err != nil {
+		return false
+	}
+	var meta cachedAsset
+	err = json.Unmarshal(metaBytes, &meta)
+	if err != nil {
+		return false
+	}
+	body, err := ioutil.ReadFile(key)
+	if err != nil {
+		return false
+	}
+
+	if meta.ContentType != "" {
+		w.Header().Set("Content-Type", meta.ContentType)
+	}
+	w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	w.WriteHeader(http.StatusOK)
+	w.Write(body)
+	return true
+}
+
+// store writes the recorded response to the cache. The body is written last
+// so a partially written entry is never served.
+func (c *assetCache) store(key string, rec *recordingWriter) error {
+	err := os.MkdirAll(c.dir, 0700)
+	if err != nil {
+		return err
+	}
+
+	meta, err := json.Marshal(cachedAsset{ContentType: rec.Header().Get("Content-Type")})
+	if err != nil {
+		return err
+	}
+	err = writeFileAtomic(key+".json", meta)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(key, rec.body.Bytes())
+}
+
+// recordingWriter passes a response through while keeping a copy of it.
+type recordingWriter struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (w *recordingWriter) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *recordingWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	w.body.Write(b)
+	return w.ResponseWriter.Write(b)
+}
+
+// cacheable reports whether the recorded response may be stored.
+func (w *recordingWriter) cacheable() bool {
+	h := w.Header()
+	if h.Get("Set-Cookie") != "" || h.Get("Content-Encoding") != "" {
+		return false
+	}
+	cc := strings.ToLower(h.Get("Cache-Control"))
+	return !strings.Contains(cc, "no-store") && !strings.Contains(cc, "private")
+}
+
+// compressibleTypes are the content type prefixes that are gzipped.
+var compressibleTypes = []string{
+	"text/",
+	"application/javascript",
+	"application/json",
+	"application/xml",
+	"image/svg+xml",
+}
+
+// gzipHandler compresses responses from next for clients that accept gzip.
+// The Accept-Encoding header isn't passed on, so that the proxy's transport
+// requests and decodes compressed responses over the tunnel itself.
+type gzipHandler struct {
+	next http.Handler
+}
+
+func (h gzipHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if isWebSocketUpgrade(r) {
+		h.next.ServeHTTP(w, r)
+		return
+	}
+
+	accepts := false
+	for _, enc := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		if strings.TrimSpace(strings.SplitN(enc, ";", 2)[0]) == "gzip" {
+			accepts = true
+		}
+	}
+	r.Header.Del("Accept-Encoding")
+	if !accepts {
+		h.next.ServeHTTP(w, r)
+		return
+	}
+
+	gw := &gzipWriter{ResponseWriter: w}
+	defer gw.Close()
+	h.next.ServeHTTP(gw, r)
+}
+
+// gzipWriter compresses the response if its content type is compressible.
+type gzipWriter struct {
+	http.ResponseWriter
+	wroteHeader bool
+	gz          *gzip.Writer
+}
+
+func (w *gzipWriter) WriteHeader(status int) {
+	if w.wroteHeader {
+		return
+	}
+	w.wroteHeader = true
+
+	h := w.Header()
+	h.Add("Vary", "Accept-Encoding")
+	if status != http.StatusOK || h.Get("Content-Encoding") != "" || !compressible(h.Get("Content-Type")) {
+		w.ResponseWriter.WriteHeader(status)
+		return
+	}
+	h.Set("Content-Encoding", "gzip")
+	h.Del("Content-Length")
+	w.gz = gzip.NewWriter(w.ResponseWriter)
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *gzipWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		if w.Header().Get("Content-Type") == "" {
+			w.Header().Set("Content-Type", http.DetectContentType(b))
+		}
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.gz != nil {
+		return w.gz.Write(b)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// Flush lets streamed responses through as they're proxied.
+func (w *gzipWriter) Flush() {
+	if w.gz != nil {
+		w.gz.Flush()
+	}
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (w *gzipWriter) Close() error {
+	if w.gz == nil {
+		return nil
+	}
+	return w.gz.Close()
+}
+
+// Hijack is passed through in case a handler takes over the connection.
+func (w *gzipWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hj, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, xerrors.New("response writer can't be hijacked")
+	}
+	return hj.Hijack()
+}
+
+func compressible(contentType string) bool {
+	for _, t := range compressibleTypes {
+		if strings.HasPrefix(contentType, t) {
+			return true
+		}
+	}
+	return false
+}
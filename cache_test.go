@@ -0,0 +1,86 @@
+package main
+
+import (
+	"compress/gzip"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestAssetCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sshcode-cache")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	hits := make(map[string]int)
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits[r.URL.RequestURI()]++
+		w.Header().Set("Content-Type", "application/javascript")
+		w.Write([]byte("console.log(1)"))
+	})
+	c := &assetCache{next: next, dir: dir}
+
+	get := func(target string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		c.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, target, nil))
+		require.Equal(t, http.StatusOK, rec.Code)
+		require.Equal(t, "console.log(1)", rec.Body.String())
+		return rec
+	}
+
+	for i := 0; i < 2; i++ {
+		rec := get("/static/out/vs/loader.js")
+		require.Equal(t, "application/javascript", rec.Header().Get("Content-Type"))
+		get("/resource/home/user/main.js")
+		get("/static/out/vs/loader.js?v=1")
+		get("/")
+	}
+	require.Equal(t, map[string]int{
+		"/static/out/vs/loader.js":     1,
+		"/resource/home/user/main.js":  2,
+		"/static/out/vs/loader.js?v=1": 2,
+		"/":                            2,
+	}, hits)
+}
+
+func TestGzipHandler(t *testing.T) {
+	var acceptEncoding string
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		acceptEncoding = r.Header.Get("Accept-Encoding")
+		if r.URL.Path == "/logo.png" {
+			w.Header().Set("Content-Type", "image/png")
+		} else {
+			w.Header().Set("Content-Type", "text/css")
+		}
+		w.Write([]byte("body { color: red }"))
+	})
+	h := gzipHandler{next: next}
+
+	req := httptest.NewRequest(http.MethodGet, "/main.css", nil)
+	req.Header.Set("Accept-Encoding", "deflate, gzip;q=1.0")
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	require.Equal(t, "", acceptEncoding)
+	require.Equal(t, "gzip", rec.Header().Get("Content-Encoding"))
+	gz, err := gzip.NewReader(rec.Body)
+	require.NoError(t, err)
+	body, err := ioutil.ReadAll(gz)
+	require.NoError(t, err)
+	require.Equal(t, "body { color: red }", string(body))
+
+	req = httptest.NewRequest(http.MethodGet, "/logo.png", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	require.Equal(t, "", rec.Header().Get("Content-Encoding"))
+
+	req = httptest.NewRequest(http.MethodGet, "/main.css", nil)
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	require.Equal(t, "", rec.Header().Get("Content-Encoding"))
+	require.Equal(t, "body { color: red }", rec.Body.String())
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"golang.org/x/xerrors"
+)
+
+const sshcodeConfigEnv = "SSHCODE_CONFIG"
+
+// config describes the optional sshcode configuration file. Flags always take
+// precedence over values read from the file.
+type config struct {
+	// Flavor is the VS Code flavor to sync settings and extensions from.
+	Flavor string `json:"flavor"`
+	// Sync maps sync categories to the direction they are synced in.
+	// See syncSpec for the list of categories and directions.
+	Sync map[string]string `json:"sync"`
+	// SecretKeys are JSON keys whose values are scrubbed from synced files,
+	// in addition to the well known ones.
+	SecretKeys []string `json:"secretKeys"`
+	// Forwards are additional forwards set up for every session, in the
+	// same LOCAL:REMOTE syntax as the --forward flag.
+	Forwards []string `json:"forwards"`
+	// Browser is the browser the editor is opened in, as in the --browser
+	// flag.
+	Browser string `json:"browser"`
+	// BrowserFlags are additional flags passed to the browser.
+	BrowserFlags []string `json:"browserFlags"`
+	// BrowserProfile is the browser profile directory to use instead of
+	// the one in sshcode's state directory.
+	BrowserProfile string `json:"browserProfile"`
+}
+
+// configPath returns the path of the sshcode configuration file.
+func configPath() string {
+	if env, ok := os.LookupEnv(sshcodeConfigEnv); ok {
+		return os.ExpandEnv(env)
+	}
+
+	base := os.Getenv("XDG_CONFIG_HOME")
+	if base == "" {
+		base = os.ExpandEnv("$HOME/.config")
+	}
+	return filepath.Join(base, "sshcode", "config.json")
+}
+
+// loadConfig reads the configuration file. A missing file is not an error.
+func loadConfig() (config, error) {
+	var conf config
+
+	path := configPath()
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return conf, nil
+	}
+	if err != nil {
+		return conf, err
+	}
+
+	err = json.Unmarshal(b, &conf)
+	if err != nil {
+		return conf, xerrors.Errorf("failed to parse %v: %w", path, err)
+	}
+	return conf, nil
+}
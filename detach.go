@@ -0,0 +1,155 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"go.coder.com/flog"
+	"golang.org/x/xerrors"
+)
+
+// detachedSessionEnv holds the session ID of a detached session's process,
+// which reports readiness on readyFD.
+const detachedSessionEnv = "SSHCODE_DETACHED_SESSION"
+
+// readyFD is the file descriptor a detached session reports readiness on.
+const readyFD = 3
+
+// detachLog is the sshcode output of a detached session, in its local
+// session directory.
+const detachLog = "sshcode.log"
+
+// readySession is what a detached session reports once it's ready.
+type readySession struct {
+	sessionInfo
+	// URL opens the editor, including any one-time token.
+	URL      string `json:"url,omitempty"`
+	Password string `json:"password,omitempty"`
+	// LoginPage is the path of a page that logs the browser in with
+	// Password, removed when the session ends.
+	LoginPage string `json:"login_page,omitempty"`
+}
+
+// detachTailLines is how many lines of a detached session's output are
+// printed if it fails to start.
+const detachTailLines = 20
+
+// runDetached starts sshcode again with the same arguments in the
+// background, waits for its session to be ready and prints how to reach it,
+// opening it in browser unless noOpen is set. Until then, ssh's prompts in
+// the background are answered on the terminal.
+func runDetached(printJSON, noOpen bool, browser browserConfig) error {
+	sessionID, err := randomID()
+	if err != nil {
+		return xerrors.Errorf("failed to generate session ID: %w", err)
+	}
+	dir, err := localSessionDir(sessionID)
+	if err != nil {
+		return xerrors.Errorf("failed to create local session directory: %w", err)
+	}
+	logPath := filepath.Join(dir, detachLog)
+	logFile, err := os.OpenFile(logPath, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return xerrors.Errorf("failed to create log: %w", err)
+	}
+	defer logFile.Close()
+
+	stopAskpass, err := serveAskpass(filepath.Join(dir, askpassSocket), terminalPrompt)
+	if err != nil {
+		return err
+	}
+	defer stopAskpass()
+
+	exe, err := os.Executable()
+	if err != nil {
+		return xerrors.Errorf("failed to find sshcode executable: %w", err)
+	}
+	r, w, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	cmd := exec.Command(exe, os.Args[1:]...)
+	cmd.Env = append(os.Environ(), detachedSessionEnv+"="+sessionID)
+	cmd.Stdout = logFile
+	cmd.Stderr = logFile
+	cmd.ExtraFiles = []*os.File{w}
+	cmd.SysProcAttr, err = detachSysProcAttr()
+	if err != nil {
+		return err
+	}
+	err = cmd.Start()
+	w.Close()
+	if err != nil {
+		return xerrors.Errorf("failed to start session: %w", err)
+	}
+
+	var ready readySession
+	err = json.NewDecoder(r).Decode(&ready)
+	if err != nil {
+		cmd.Wait()
+		printLogTail(os.Stderr, logPath, detachTailLines)
+		return xerrors.Errorf("session failed to start, see %v", logPath)
+	}
+	cmd.Process.Release()
+	// Prompts from now on fail rather than wait for an answer no one gives.
+	stopAskpass()
+
+	if !noOpen && !strings.HasPrefix(ready.URL, unixBindPrefix) {
+		openURL := ready.URL
+		if ready.LoginPage != "" {
+			openURL = "file://" + filepath.ToSlash(ready.LoginPage)
+		}
+		err = browser.open(openURL)
+		if err != nil {
+			flog.Error("failed to open browser: %v", err)
+		}
+	}
+
+	if printJSON {
+		return json.NewEncoder(os.Stdout).Encode(ready)
+	}
+	fmt.Printf("session: %v\n", ready.ID)
+	fmt.Printf("url: %v\n", ready.URL)
+	if ready.Password != "" {
+		fmt.Printf("password: %v\n", ready.Password)
+	}
+	return nil
+}
+
+// printLogTail prints the last n lines of the log at path to out.
+func printLogTail(out io.Writer, path string, n int) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil || len(b) == 0 {
+		return
+	}
+	lines := strings.Split(strings.TrimRight(string(b), "\n"), "\n")
+	if len(lines) > n {
+		lines = lines[len(lines)-n:]
+	}
+	fmt.Fprintf(out, "---last lines of sshcode output---\n%v\n---\n", strings.Join(lines, "\n"))
+}
+
+// detachedReady returns the function a detached session calls to report it's
+// ready to the process that started it.
+func detachedReady() func(readySession) {
+	f := os.NewFile(readyFD, "ready")
+	// Don't pass the pipe on to ssh and other commands, or the parent
+	// wouldn't notice this process failing.
+	closeOnExec(f)
+
+	return func(s readySession) {
+		err := json.NewEncoder(f).Encode(s)
+		if err != nil {
+			flog.Error("failed to report readiness: %v", err)
+		}
+		f.Close()
+	}
+}
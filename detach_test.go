@@ -0,0 +1,91 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// detachedHelperEnv makes TestDetachedHelper act as a detached session.
+const detachedHelperEnv = "SSHCODE_TEST_DETACHED_HELPER"
+
+// TestDetachedHelper isn't a real test. TestDetachedReady runs the test
+// binary with it as a detached session.
+func TestDetachedHelper(t *testing.T) {
+	switch os.Getenv(detachedHelperEnv) {
+	case "ready":
+		ready := detachedReady()
+		// Commands started by the session don't hold on to the pipe.
+		require.NoError(t, exec.Command("sh", "-c", "sleep 5 >/dev/null 2>&1 &").Run())
+		ready(readySession{
+			sessionInfo: sessionInfo{ID: os.Getenv(detachedSessionEnv)},
+			URL:         "http://127.0.0.1:8080",
+			Password:    "pw",
+			LoginPage:   "/tmp/sshcode-login-1.html",
+		})
+	case "fail":
+		detachedReady()
+		require.NoError(t, exec.Command("sh", "-c", "sleep 5 >/dev/null 2>&1 &").Run())
+		os.Exit(1)
+	}
+}
+
+func TestDetachedReady(t *testing.T) {
+	run := func(mode string) (readySession, error) {
+		r, w, err := os.Pipe()
+		require.NoError(t, err)
+		defer r.Close()
+
+		cmd := exec.Command(os.Args[0], "-test.run=^TestDetachedHelper$")
+		cmd.Env = append(os.Environ(), detachedHelperEnv+"="+mode, detachedSessionEnv+"=abc")
+		cmd.ExtraFiles = []*os.File{w}
+		require.NoError(t, cmd.Start())
+		w.Close()
+		defer cmd.Wait()
+
+		var ready readySession
+		err = json.NewDecoder(r).Decode(&ready)
+		return ready, err
+	}
+
+	ready, err := run("ready")
+	require.NoError(t, err)
+	require.Equal(t, "abc", ready.ID)
+	require.Equal(t, "http://127.0.0.1:8080", ready.URL)
+	require.Equal(t, "/tmp/sshcode-login-1.html", ready.LoginPage)
+
+	_, err = run("fail")
+	require.Error(t, err)
+}
+
+func TestPrintLogTail(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sshcode-log")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, detachLog)
+	var lines []string
+	for i := 0; i < 30; i++ {
+		lines = append(lines, "line "+strconv.Itoa(i))
+	}
+	require.NoError(t, ioutil.WriteFile(path, []byte(strings.Join(lines, "\n")+"\n"), 0600))
+
+	var out bytes.Buffer
+	printLogTail(&out, path, 3)
+	require.Equal(t, "---last lines of sshcode output---\nline 27\nline 28\nline 29\n---\n", out.String())
+
+	// Missing and empty logs print nothing.
+	out.Reset()
+	printLogTail(&out, filepath.Join(dir, "missing"), 3)
+	require.NoError(t, ioutil.WriteFile(path, nil, 0600))
+	printLogTail(&out, path, 3)
+	require.Empty(t, out.String())
+}
@@ -0,0 +1,19 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// detachSysProcAttr starts a process in a session of its own, so it isn't
+// affected by the terminal it was started from.
+func detachSysProcAttr() (*syscall.SysProcAttr, error) {
+	return &syscall.SysProcAttr{Setsid: true}, nil
+}
+
+func closeOnExec(f *os.File) {
+	syscall.CloseOnExec(int(f.Fd()))
+}
@@ -0,0 +1,14 @@
+package main
+
+import (
+	"os"
+	"syscall"
+
+	"golang.org/x/xerrors"
+)
+
+func detachSysProcAttr() (*syscall.SysProcAttr, error) {
+	return nil, xerrors.New("--detach isn't supported on Windows")
+}
+
+func closeOnExec(f *os.File) {}
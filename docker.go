@@ -0,0 +1,157 @@
+package main
+
+import (
+	"net/url"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/xerrors"
+)
+
+// dockerProvider resolves running containers, given as
+// docker:CONTAINER[?OPTIONS], which are reached with docker exec and docker cp
+// rather than ssh, so they don't need to run sshd. The options are:
+//
+//	user     the user to run code-server as, the container's by default
+//	context  the docker context to use, e.g. one for a remote daemon
+//
+// Settings and extensions are only copied in. -b, --push and --forward are
+// built on rsync and ssh, so they're refused for containers.
+type dockerProvider struct{}
+
+func (dockerProvider) resolve(addr string) (target, error) {
+	name, rawQuery := addr, ""
+	if i := strings.Index(addr, "?"); i >= 0 {
+		name, rawQuery = addr[:i], addr[i+1:]
+	}
+	opts, err := url.ParseQuery(rawQuery)
+	if err != nil {
+		return target{}, xerrors.Errorf("invalid options: %w", err)
+	}
+	for k := range opts {
+		switch k {
+		case "user", "context":
+		default:
+			return target{}, xerrors.Errorf("unknown option %q", k)
+		}
+	}
+	if name == "" {
+		return target{}, xerrors.New("expected docker:CONTAINER")
+	}
+
+	d := &dockerTransport{
+		container: name,
+		user:      opts.Get("user"),
+		context:   opts.Get("context"),
+	}
+	out, err := d.docker("inspect", "--format", "{{.State.Running}}", name).Output()
+	if err != nil {
+		return target{}, xerrors.Errorf("failed to inspect container %v: %v: %w", name, commandStderr(err), err)
+	}
+	if strings.TrimSpace(string(out)) != "true" {
+		return target{}, xerrors.Errorf("container %v isn't running", name)
+	}
+
+	t := target{host: name, transport: d}
+	return t, t.validate()
+}
+
+// dockerTransport runs commands in a container with docker exec.
+type dockerTransport struct {
+	container string
+	user      string
+	context   string
+
+	// home, uid and gid are those of the user in the container, once looked
+	// up.
+	home string
+	uid  string
+	gid  string
+}
+
+// docker returns a docker command using the transport's context.
+func (d *dockerTransport) docker(args ...string) *exec.Cmd {
+	if d.context != "" {
+		args = append([]string{"--context", d.context}, args...)
+	}
+	return exec.Command("docker", args...)
+}
+
+// execCmd returns a docker exec command running args in the container as
+// user, or as the transport's user if empty.
+func (d *dockerTransport) execCmd(user string, args ...string) *exec.Cmd {
+	if user == "" {
+		user = d.user
+	}
+	execArgs := []string{"exec", "-i"}
+	if user != "" {
+		execArgs = append(execArgs, "--user", user)
+	}
+	execArgs = append(execArgs, d.container)
+	return d.docker(append(execArgs, args...)...)
+}
+
+func (d *dockerTransport) command(script string) *exec.Cmd {
+	return d.execCmd("", "sh", "-c", script)
+}
+
+func (d *dockerTransport) copyTo(src, dst string) error {
+	info, err := os.Stat(src)
+	if err != nil {
+		return err
+	}
+	err = d.lookupUser()
+	if err != nil {
+		return err
+	}
+	// docker cp doesn't expand ~.
+	if dst == "~" || strings.HasPrefix(dst, "~/") {
+		dst = d.home + dst[1:]
+	}
+
+	dir := path.Dir(dst)
+	if info.IsDir() {
+		dir = dst
+		// Copy the contents of the directory rather than the directory.
+		src += string(filepath.Separator) + "."
+	}
+	out, err := d.command(`mkdir -p "` + dir + `"`).CombinedOutput()
+	if err != nil {
+		return xerrors.Errorf("failed to create %v: %s: %w", dir, out, err)
+	}
+
+	out, err = d.docker("cp", src, d.container+":"+dst).CombinedOutput()
+	if err != nil {
+		return xerrors.Errorf("failed to copy %v to %v: %s: %w", src, dst, out, err)
+	}
+
+	// docker cp creates files as root, so hand them to the user.
+	if d.uid != "0" {
+		out, err = d.execCmd("0", "chown", "-R", d.uid+":"+d.gid, dst).CombinedOutput()
+		if err != nil {
+			return xerrors.Errorf("failed to change the owner of %v: %s: %w", dst, out, err)
+		}
+	}
+	return nil
+}
+
+// lookupUser looks up the home directory and IDs of the user commands run
+// as.
+func (d *dockerTransport) lookupUser() error {
+	if d.home != "" {
+		return nil
+	}
+	out, err := d.command(`echo "$HOME"; id -u; id -g`).Output()
+	if err != nil {
+		return xerrors.Errorf("failed to look up user in container %v: %v: %w", d.container, commandStderr(err), err)
+	}
+	fields := strings.Fields(string(out))
+	if len(fields) != 3 || !strings.HasPrefix(fields[0], "/") {
+		return xerrors.Errorf("unexpected user details %q", out)
+	}
+	d.home, d.uid, d.gid = fields[0], fields[1], fields[2]
+	return nil
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// fakeDocker answers inspect and the user lookup, and records its arguments.
+const fakeDocker = `#!/bin/sh
+echo "$@" >> "$(dirname "$0")/args"
+case "$*" in
+*"inspect"*" dev")
+	echo true
+	;;
+*"inspect"*" stopped")
+	echo false
+	;;
+*"inspect"*)
+	echo "Error: No such object: missing" >&2
+	exit 1
+	;;
+*"id -u"*)
+	printf '/home/dev\n1000\n1000\n'
+	;;
+esac
+`
+
+func TestDockerProvider(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sshcode-docker")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	err = ioutil.WriteFile(filepath.Join(dir, "docker"), []byte(fakeDocker), 0755)
+	require.NoError(t, err)
+	defer os.Setenv("PATH", os.Getenv("PATH"))
+	os.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	for host, wantErr := range map[string]string{
+		"docker:stopped":       "container stopped isn't running",
+		"docker:missing":       "No such object: missing",
+		"docker:dev?color=red": `unknown option "color"`,
+	} {
+		_, err := parseHost(host)
+		require.Error(t, err, host)
+		require.Contains(t, err.Error(), wantErr)
+	}
+
+	target, err := parseHost("docker:dev?user=dev&context=remote")
+	require.NoError(t, err)
+	require.Equal(t, "dev", target.destination())
+	tr, ok := target.transport.(*dockerTransport)
+	require.True(t, ok)
+	require.Equal(t, []string{
+		"docker", "--context", "remote", "exec", "-i", "--user", "dev", "dev", "sh", "-c", "echo hi",
+	}, tr.command("echo hi").Args)
+
+	src := filepath.Join(dir, "settings")
+	require.NoError(t, os.Mkdir(src, 0700))
+	err = tr.copyTo(src, "~/.local/share/code-server/User")
+	require.NoError(t, err)
+
+	args, err := ioutil.ReadFile(filepath.Join(dir, "args"))
+	require.NoError(t, err)
+	require.Contains(t, string(args), "--context remote cp "+src+"/. dev:/home/dev/.local/share/code-server/User\n")
+	require.Contains(t, string(args), "--context remote exec -i --user 0 dev chown -R 1000:1000 /home/dev/.local/share/code-server/User\n")
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"golang.org/x/xerrors"
+)
+
+// forward is an additional port forward carried by the session's tunnel.
+// Either end is a [HOST:]PORT address or a Unix socket path.
+type forward struct {
+	local  string
+	remote string
+}
+
+// parseForward parses a forward in LOCAL:REMOTE syntax, where LOCAL is
+// [HOST:]PORT or a local Unix socket path and REMOTE is [HOST:]PORT or a
+// remote Unix socket path. REMOTE defaults to the same port as LOCAL, and
+// hosts default to loopback addresses.
+func parseForward(s string) (forward, error) {
+	toks := strings.Split(s, ":")
+
+	local, n, err := parseForwardEnd(toks, "127.0.0.1")
+	if err != nil {
+		return forward{}, xerrors.Errorf("invalid local address in %q: %w", s, err)
+	}
+	toks = toks[n:]
+
+	if len(toks) == 0 {
+		if isSocketPath(local) {
+			return forward{}, xerrors.Errorf("missing remote address in %q", s)
+		}
+		_, port, _ := splitForwardAddr(local)
+		return forward{local: local, remote: "localhost:" + port}, nil
+	}
+
+	remote, n, err := parseForwardEnd(toks, "localhost")
+	if err != nil {
+		return forward{}, xerrors.Errorf("invalid remote address in %q: %w", s, err)
+	}
+	if isSocketPath(remote) && !strings.HasPrefix(remote, "/") {
+		return forward{}, xerrors.Errorf("remote socket path in %q must be absolute", s)
+	}
+	if n != len(toks) {
+		return forward{}, xerrors.Errorf("invalid forward %q, expected LOCAL:REMOTE", s)
+	}
+	return forward{local: local, remote: remote}, nil
+}
+
+// parseForwardEnd parses one end of a forward from the start of toks and
+// returns it along with the number of tokens consumed.
+func parseForwardEnd(toks []string, defaultHost string) (string, int, error) {
+	switch {
+	case toks[0] == "":
+		return "", 0, xerrors.New("empty address")
+	case isSocketPath(toks[0]):
+		return toks[0], 1, nil
+	case isPort(toks[0]):
+		return defaultHost + ":" + toks[0], 1, nil
+	case len(toks) > 1 && isPort(toks[1]):
+		return toks[0] + ":" + toks[1], 2, nil
+	default:
+		return "", 0, xerrors.Errorf("%q is not a port, HOST:PORT or socket path", toks[0])
+	}
+}
+
+func isSocketPath(s string) bool {
+	return strings.HasPrefix(s, "/") || strings.HasPrefix(s, "./") || strings.HasPrefix(s, "~/")
+}
+
+func isPort(s string) bool {
+	port, err := strconv.Atoi(s)
+	return err == nil && port > 0 && port <= 65535
+}
+
+func splitForwardAddr(addr string) (host, port string, ok bool) {
+	i := strings.LastIndex(addr, ":")
+	if i < 0 {
+		return "", "", false
+	}
+	return addr[:i], addr[i+1:], true
+}
+
+// sshFlag returns the ssh flag that sets up f.
+func (f forward) sshFlag() string {
+	local := f.local
+	if isSocketPath(local) {
+		local = expandPath(local)
+	}
+	return fmt.Sprintf("-L '%v:%v'", local, f.remote)
+}
+
+// localURL returns the address users reach the forward at.
+func (f forward) localURL() string {
+	if isSocketPath(f.local) {
+		return expandPath(f.local)
+	}
+	return "http://" + f.local
+}
+
+// forwardFlags returns the ssh flags for forwards.
+func forwardFlags(forwards []forward) string {
+	flags := make([]string, len(forwards))
+	for i, f := range forwards {
+		flags[i] = f.sshFlag()
+	}
+	if len(forwards) > 0 {
+		// Replace sockets left behind by previous sessions.
+		flags = append(flags, "-o StreamLocalBindUnlink=yes")
+	}
+	return strings.Join(flags, " ")
+}
+
+// forwardRemotes returns the remote ends of forwards.
+func forwardRemotes(forwards []forward) []string {
+	remotes := make([]string, len(forwards))
+	for i, f := range forwards {
+		remotes[i] = f.remote
+	}
+	return remotes
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseForward(t *testing.T) {
+	tests := []struct {
+		in   string
+		want forward
+		err  bool
+	}{
+		{in: "3000", want: forward{"127.0.0.1:3000", "localhost:3000"}},
+		{in: "8080:3000", want: forward{"127.0.0.1:8080", "localhost:3000"}},
+		{in: "0.0.0.0:8080:3000", want: forward{"0.0.0.0:8080", "localhost:3000"}},
+		{in: "8080:db:5432", want: forward{"127.0.0.1:8080", "db:5432"}},
+		{in: "8080:/run/app.sock", want: forward{"127.0.0.1:8080", "/run/app.sock"}},
+		{in: "/tmp/docker.sock:/var/run/docker.sock", want: forward{"/tmp/docker.sock", "/var/run/docker.sock"}},
+		{in: "/tmp/docker.sock", err: true},
+		{in: "8080:~/app.sock", err: true},
+		{in: "8080:3000:4000", err: true},
+		{in: "web", err: true},
+		{in: "", err: true},
+	}
+	for _, test := range tests {
+		f, err := parseForward(test.in)
+		if test.err {
+			require.Error(t, err, test.in)
+			continue
+		}
+		require.NoError(t, err, test.in)
+		require.Equal(t, test.want, f, test.in)
+	}
+}
@@ -0,0 +1,412 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.coder.com/flog"
+	"golang.org/x/xerrors"
+)
+
+const (
+	// gcpStartTimeout is how long a stopped instance has to start, and then
+	// to accept SSH connections.
+	gcpStartTimeout = 5 * time.Minute
+	// gcpPollInterval is how often an instance that's changing state is
+	// checked on.
+	gcpPollInterval = 5 * time.Second
+	// gcpIdleCheckInterval is how often an instance with the idle option is
+	// checked for activity once the session ends.
+	gcpIdleCheckInterval = time.Minute
+)
+
+// gcpIdleWatcher is where the script that shuts an idle instance down is
+// written on the instance, and gcpIdlePIDFile where its PID is recorded.
+const (
+	gcpIdleWatcher = "~/.cache/sshcode/idle-watch.sh"
+	gcpIdlePIDFile = "~/.cache/sshcode/idle-watch.pid"
+)
+
+// gcpIdleScript checks the instance for activity every %[2]v seconds, and
+// shuts it down once it has found none %[1]v times in a row. The instance is
+// active while a code-server started by sshcode runs or anyone is logged in.
+const gcpIdleScript = `idle=0
+while sleep %[2]v; do
+	if pgrep -f %[3]v >/dev/null || [ -n "$(who)" ]; then
+		idle=0
+	elif [ $((idle += 1)) -ge %[1]v ]; then
+		rm -f ` + gcpIdlePIDFile + `
+		exec sudo -n shutdown -h now
+	fi
+done
+`
+
+// gcpCancelShutdownScript cancels a shutdown scheduled with shutdown -h.
+const gcpCancelShutdownScript = "sudo shutdown -c"
+
+// gcpCancelIdleScript stops the idle watcher, if it's running.
+const gcpCancelIdleScript = `[ -f ` + gcpIdlePIDFile + ` ] && kill $(cat ` + gcpIdlePIDFile + `); rm -f ` + gcpIdlePIDFile
+
+// gcpIdleWatchScript writes the script shutting the instance down once it
+// has been idle for after, checking every interval, to gcpIdleWatcher and
+// starts it in the background in place of any earlier one. The script is run
+// from a file so its command line doesn't match the code-servers it looks
+// for.
+func gcpIdleWatchScript(after, interval time.Duration) string {
+	checks := int(math.Ceil(float64(after) / float64(interval)))
+	// The shell expands ~ in code-server's path before running it.
+	pattern := strings.Replace(codeServerPath, "~", `"$HOME"`, 1)
+	watcher := fmt.Sprintf(gcpIdleScript, checks, interval.Seconds(), pattern)
+	return fmt.Sprintf("mkdir -p ~/.cache/sshcode && cat > %v <<'EOF'\n%vEOF\n%v\nnohup sh %v </dev/null >/dev/null 2>&1 &\necho $! > %v",
+		gcpIdleWatcher, watcher, gcpCancelIdleScript, gcpIdleWatcher, gcpIdlePIDFile)
+}
+
+// gcpProvider resolves Google Compute Engine instances, given as
+// gcp:INSTANCE[?OPTIONS] or gcp://PROJECT/ZONE/INSTANCE[/DIR][?OPTIONS],
+// using gcloud. Stopped and suspended instances are started when the session
+// starts. The options are:
+//
+//	stop      stop the instance when the session ends if true
+//	shutdown  shut the instance down this long after the session ends,
+//	          e.g. 2h, unless another session has started by then
+//	idle      shut the instance down once it has been idle this long after
+//	          the session ends, e.g. 30m: no code-server started by sshcode
+//	          ran and no one was logged in
+//
+// Only one can be given. None stops an instance another session on this
+// machine is using.
+type gcpProvider struct{}
+
+func (gcpProvider) resolve(addr string) (target, error) {
+	args, dir, opts, err := parseGCPAddr(addr)
+	if err != nil {
+		return target{}, err
+	}
+	hooks := &gcpHooks{args: args}
+	if v := opts.Get("stop"); v != "" {
+		hooks.stopOnEnd, err = strconv.ParseBool(v)
+		if err != nil {
+			return target{}, xerrors.Errorf("invalid stop option %q", v)
+		}
+	}
+	if v := opts.Get("shutdown"); v != "" {
+		hooks.shutdownAfter, err = time.ParseDuration(v)
+		if err != nil || hooks.shutdownAfter <= 0 {
+			return target{}, xerrors.Errorf("invalid shutdown option %q, expected a duration like 2h", v)
+		}
+	}
+	if v := opts.Get("idle"); v != "" {
+		hooks.idleAfter, err = time.ParseDuration(v)
+		if err != nil || hooks.idleAfter <= 0 {
+			return target{}, xerrors.Errorf("invalid idle option %q, expected a duration like 30m", v)
+		}
+	}
+	if len(opts) > 1 {
+		return target{}, xerrors.New("only one of the stop, shutdown and idle options can be given")
+	}
+	// The instance's address is only known once it's running, so the hooks
+	// provide it.
+	return target{dir: dir, hooks: hooks}, nil
+}
+
+// parseGCPAddr parses the address of a gcp: host and returns the gcloud
+// arguments that select the instance along with the directory and options.
+func parseGCPAddr(addr string) (args []string, dir string, opts url.Values, err error) {
+	name, rawQuery := addr, ""
+	if i := strings.Index(addr, "?"); i >= 0 {
+		name, rawQuery = addr[:i], addr[i+1:]
+	}
+	opts, err = url.ParseQuery(rawQuery)
+	if err != nil {
+		return nil, "", nil, xerrors.Errorf("invalid options: %w", err)
+	}
+	for k := range opts {
+		switch k {
+		case "stop", "shutdown", "idle":
+		default:
+			return nil, "", nil, xerrors.Errorf("unknown option %q", k)
+		}
+	}
+
+	if strings.HasPrefix(name, "//") {
+		args, dir, err = parseGCPURI("gcp:" + name)
+		return args, dir, opts, err
+	}
+	args = strings.Fields(name)
+	if len(args) == 0 {
+		return nil, "", nil, xerrors.New("expected gcp:INSTANCE")
+	}
+	return args, "", opts, nil
+}
+
+// parseGCPURI parses a target in gcp://PROJECT/ZONE/INSTANCE[/DIR] syntax and
+// returns the gcloud arguments that select the instance along with the
+// directory.
+func parseGCPURI(s string) (args []string, dir string, err error) {
+	rest := strings.TrimPrefix(s, "gcp://")
+	toks := strings.SplitN(rest, "/", 4)
+	if len(toks) < 3 || toks[0] == "" || toks[1] == "" || toks[2] == "" {
+		return nil, "", xerrors.Errorf("invalid target %q, expected gcp://PROJECT/ZONE/INSTANCE[/DIR]", s)
+	}
+	for _, tok := range toks[:3] {
+		if !safeSSHArg.MatchString(tok) {
+			return nil, "", xerrors.Errorf("invalid characters in %q", tok)
+		}
+	}
+	if len(toks) == 4 {
+		dir = uriDir("/" + toks[3])
+	}
+	return []string{"--project", toks[0], "--zone", toks[1], toks[2]}, dir, nil
+}
+
+// parseGCPSSHCmd parses the IP address and flags used by 'gcloud' when
+// ssh'ing to the instance selected by args.
+func parseGCPSSHCmd(args []string) (ip, sshFlags string, err error) {
+	out, err := exec.Command("gcloud", append([]string{"compute", "ssh", "--dry-run"}, args...)...).Output()
+	if err != nil {
+		return "", "", xerrors.Errorf("gcloud compute ssh --dry-run failed: %v: %w", commandStderr(err), err)
+	}
+
+	toks := strings.Split(strings.TrimSpace(string(out)), " ")
+	if len(toks) < 2 {
+		return "", "", xerrors.Errorf("unexpected output for gcloud compute ssh --dry-run, %s", out)
+	}
+
+	// Slice off the '/usr/bin/ssh' prefix and the '<user>@<ip>' suffix.
+	sshFlags = strings.Join(toks[1:len(toks)-1], " ")
+
+	// E.g. foo@1.2.3.4.
+	userIP := toks[len(toks)-1]
+
+	return userIP, sshFlags, nil
+}
+
+// gcloudInstances runs 'gcloud compute instances' with args.
+func gcloudInstances(args ...string) ([]byte, error) {
+	out, err := exec.Command("gcloud", append([]string{"compute", "instances"}, args...)...).Output()
+	if err != nil {
+		return nil, xerrors.Errorf("gcloud compute instances %v failed: %v: %w", args[0], commandStderr(err), err)
+	}
+	return out, nil
+}
+
+// ensureGCPRunning starts or resumes the instance if it's stopped or
+// suspended, and waits for it to be running. It reports whether the instance
+// had to be started.
+func ensureGCPRunning(args []string) (bool, error) {
+	var (
+		deadline  = time.Now().Add(gcpStartTimeout)
+		requested bool
+	)
+	for {
+		out, err := gcloudInstances(append(append([]string{"describe"}, args...), "--format=value(status)")...)
+		if err != nil {
+			return false, err
+		}
+		status := strings.TrimSpace(string(out))
+
+		switch status {
+		case "RUNNING":
+			return requested, nil
+		case "TERMINATED", "STOPPED", "SUSPENDED":
+			if requested {
+				break
+			}
+			verb, doing := "start", "starting"
+			if status == "SUSPENDED" {
+				verb, doing = "resume", "resuming"
+			}
+			flog.Info("instance %v is %v, %v it...", args[len(args)-1], strings.ToLower(status), doing)
+			_, err = gcloudInstances(append([]string{verb}, args...)...)
+			if err != nil {
+				return false, err
+			}
+			requested = true
+			continue
+		}
+
+		if time.Now().After(deadline) {
+			return false, xerrors.Errorf("instance %v is still %v after %v", args[len(args)-1], status, gcpStartTimeout)
+		}
+		time.Sleep(gcpPollInterval)
+	}
+}
+
+// waitForSSH waits for a host that just started to accept SSH connections.
+func waitForSSH(tr sshTransport) error {
+	flog.Info("waiting for SSH...")
+	tr.sshFlags += " -o BatchMode=yes -o ConnectTimeout=10"
+
+	deadline := time.Now().Add(gcpStartTimeout)
+	for {
+		out, err := tr.command("true").CombinedOutput()
+		if err == nil {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return xerrors.Errorf("%v didn't accept SSH connections within %v: %s: %w", tr.host, gcpStartTimeout, out, err)
+		}
+		time.Sleep(gcpPollInterval)
+	}
+}
+
+// gcpHooks starts an instance before the session if needed, and stops it,
+// schedules its shutdown or has it shut down once idle, when the session
+// ends if asked to. A shutdown arranged by an earlier session is cancelled
+// before the session starts.
+type gcpHooks struct {
+	args          []string
+	stopOnEnd     bool
+	shutdownAfter time.Duration
+	idleAfter     time.Duration
+
+	// host and sshFlags reach the instance once it has started.
+	host     string
+	sshFlags string
+	// ssh runs commands on the instance. It's an sshTransport unless set
+	// beforehand.
+	ssh transport
+}
+
+// shutdownMarker is the file that records that a shutdown was scheduled on
+// the instance. It holds the script that cancels it.
+func (h *gcpHooks) shutdownMarker() string {
+	return filepath.Join(stateDir(), "gcp-shutdown", url.PathEscape(strings.Join(h.args, " ")))
+}
+
+func (h *gcpHooks) start() error {
+	started, err := ensureGCPRunning(h.args)
+	if err != nil {
+		return err
+	}
+	err = h.connect(started)
+	if err != nil {
+		if started && (h.stopOnEnd || h.shutdownAfter > 0 || h.idleAfter > 0) {
+			// The session won't run, so its stop hook won't either, and
+			// there's no session to wait for before shutting down.
+			if err := h.stopInstance(); err != nil {
+				flog.Error("failed to stop instance: %v", err)
+			}
+		}
+		return err
+	}
+
+	marker := h.shutdownMarker()
+	cancel, err := ioutil.ReadFile(marker)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	// Markers written before they held the script cancel a shutdown.
+	if len(cancel) == 0 {
+		cancel = []byte(gcpCancelShutdownScript)
+	}
+	// The shutdown may have happened already, which is fine as the instance
+	// was started again.
+	out, err := h.ssh.command(string(cancel)).CombinedOutput()
+	if err != nil {
+		flog.Info("no scheduled shutdown to cancel: %s", strings.TrimSpace(string(out)))
+	} else {
+		flog.Info("cancelled scheduled shutdown")
+	}
+	return os.Remove(marker)
+}
+
+// connect looks up how to reach the running instance, and waits for it to
+// accept SSH connections if it was just started.
+func (h *gcpHooks) connect(started bool) error {
+	var err error
+	h.host, h.sshFlags, err = parseGCPSSHCmd(h.args)
+	if err != nil {
+		return err
+	}
+	if h.ssh == nil {
+		h.ssh = sshTransport{sshFlags: h.sshFlags, host: h.host}
+	}
+	if started {
+		return waitForSSH(sshTransport{sshFlags: h.sshFlags, host: h.host})
+	}
+	return nil
+}
+
+func (h *gcpHooks) address() (host, sshFlags string) {
+	return h.host, h.sshFlags
+}
+
+func (h *gcpHooks) stop() error {
+	if !h.stopOnEnd && h.shutdownAfter == 0 && h.idleAfter == 0 {
+		return nil
+	}
+	instance := h.args[len(h.args)-1]
+	busy, err := gcpInstanceBusy(h.args)
+	if err != nil {
+		return err
+	}
+	if busy {
+		flog.Info("leaving instance %v running for other sessions", instance)
+		return nil
+	}
+
+	if h.stopOnEnd {
+		return h.stopInstance()
+	}
+
+	cancel := gcpCancelShutdownScript
+	if h.idleAfter > 0 {
+		out, err := h.ssh.command(gcpIdleWatchScript(h.idleAfter, gcpIdleCheckInterval)).CombinedOutput()
+		if err != nil {
+			return xerrors.Errorf("failed to start idle watcher: %s: %w", out, err)
+		}
+		flog.Info("instance %v will shut down once it has been idle for %v", instance, h.idleAfter)
+		cancel = gcpCancelIdleScript
+	} else {
+		minutes := int(math.Ceil(h.shutdownAfter.Minutes()))
+		out, err := h.ssh.command(fmt.Sprintf("sudo shutdown -h +%v", minutes)).CombinedOutput()
+		if err != nil {
+			return xerrors.Errorf("failed to schedule shutdown: %s: %w", out, err)
+		}
+		flog.Info("instance %v will shut down in %v unless a session starts", instance, time.Duration(minutes)*time.Minute)
+	}
+
+	marker := h.shutdownMarker()
+	err = os.MkdirAll(filepath.Dir(marker), 0700)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(marker, []byte(cancel), 0600)
+}
+
+func (h *gcpHooks) stopInstance() error {
+	flog.Info("stopping instance %v", h.args[len(h.args)-1])
+	_, err := gcloudInstances(append([]string{"stop"}, h.args...)...)
+	return err
+}
+
+// gcpInstanceBusy reports whether another session on this machine is using
+// the instance.
+func gcpInstanceBusy(args []string) (bool, error) {
+	sessions, err := listSessions()
+	if err != nil {
+		return false, xerrors.Errorf("failed to list sessions: %w", err)
+	}
+	for _, s := range sessions {
+		if s.PID == os.Getpid() || !s.running() || !strings.HasPrefix(s.Host, "gcp:") {
+			continue
+		}
+		otherArgs, _, _, err := parseGCPAddr(strings.TrimPrefix(s.Host, "gcp:"))
+		if err == nil && strings.Join(otherArgs, " ") == strings.Join(args, " ") {
+			return true, nil
+		}
+	}
+	return false, nil
+}
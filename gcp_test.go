@@ -0,0 +1,272 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// fakeGcloud reports the status in the status file next to it, which start
+// and resume set to RUNNING, and records its arguments. ssh --dry-run fails
+// if there's a dry-run-fails file next to it.
+const fakeGcloud = `#!/bin/sh
+dir=$(dirname "$0")
+echo "$@" >> "$dir/args"
+case "$*" in
+*" describe "*)
+	cat "$dir/status"
+	;;
+*" start "*|*" resume "*)
+	echo RUNNING > "$dir/status"
+	;;
+"compute ssh --dry-run "*)
+	if [ -f "$dir/dry-run-fails" ]; then
+		echo "ERROR: no route to instance" >&2
+		exit 1
+	fi
+	echo "/usr/bin/ssh -t -i /keys/gce -o CheckHostIP=no dev@10.0.0.9"
+	;;
+esac
+`
+
+// recordTransport appends the scripts it's asked to run to a file, in place
+// of running them on an instance.
+type recordTransport struct {
+	path string
+}
+
+func (r recordTransport) command(script string) *exec.Cmd {
+	return exec.Command("sh", "-c", `echo "$1" >> "$0"`, r.path, script)
+}
+
+func (recordTransport) copyTo(src, dst string) error {
+	return nil
+}
+
+// installFakeGcloud puts fakeGcloud on PATH and points the state directory
+// at dir, returning a function that undoes it.
+func installFakeGcloud(t *testing.T, dir string) func() {
+	err := ioutil.WriteFile(filepath.Join(dir, "gcloud"), []byte(fakeGcloud), 0755)
+	require.NoError(t, err)
+
+	path, stateHome := os.Getenv("PATH"), os.Getenv("XDG_STATE_HOME")
+	os.Setenv("PATH", dir+string(os.PathListSeparator)+path)
+	os.Setenv("XDG_STATE_HOME", dir)
+	return func() {
+		os.Setenv("PATH", path)
+		os.Setenv("XDG_STATE_HOME", stateHome)
+	}
+}
+
+func TestParseGCPAddr(t *testing.T) {
+	args, dir, opts, err := parseGCPAddr("//my-project/us-central1-a/dev/~/src?stop=true")
+	require.NoError(t, err)
+	require.Equal(t, []string{"--project", "my-project", "--zone", "us-central1-a", "dev"}, args)
+	require.Equal(t, "~/src", dir)
+	require.Equal(t, "true", opts.Get("stop"))
+
+	args, _, opts, err = parseGCPAddr("dev?shutdown=2h")
+	require.NoError(t, err)
+	require.Equal(t, []string{"dev"}, args)
+	require.Equal(t, "2h", opts.Get("shutdown"))
+
+	_, _, _, err = parseGCPAddr("dev?color=red")
+	require.Error(t, err)
+
+	_, err = gcpProvider{}.resolve("dev?idle=30m")
+	require.NoError(t, err)
+	_, err = gcpProvider{}.resolve("dev?idle=30m&shutdown=2h")
+	require.Error(t, err)
+	_, err = gcpProvider{}.resolve("dev?idle=soon")
+	require.Error(t, err)
+}
+
+func TestEnsureGCPRunning(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sshcode-gcp")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	defer installFakeGcloud(t, dir)()
+
+	tcs := []struct {
+		status  string
+		started bool
+		command string
+	}{
+		{status: "RUNNING"},
+		{status: "TERMINATED", started: true, command: "compute instances start --zone z dev"},
+		{status: "SUSPENDED", started: true, command: "compute instances resume --zone z dev"},
+	}
+	for _, tc := range tcs {
+		t.Run(tc.status, func(t *testing.T) {
+			os.Remove(filepath.Join(dir, "args"))
+			err := ioutil.WriteFile(filepath.Join(dir, "status"), []byte(tc.status+"\n"), 0644)
+			require.NoError(t, err)
+
+			started, err := ensureGCPRunning([]string{"--zone", "z", "dev"})
+			require.NoError(t, err)
+			require.Equal(t, tc.started, started)
+
+			args, err := ioutil.ReadFile(filepath.Join(dir, "args"))
+			require.NoError(t, err)
+			require.True(t, strings.HasPrefix(string(args), "compute instances describe --zone z dev --format=value(status)\n"))
+			if tc.command != "" {
+				require.Contains(t, string(args), tc.command+"\n")
+			}
+		})
+	}
+}
+
+func TestGCPHooksStop(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sshcode-gcp")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	defer installFakeGcloud(t, dir)()
+
+	h := &gcpHooks{args: []string{"dev"}, stopOnEnd: true}
+	require.NoError(t, h.stop())
+	args, err := ioutil.ReadFile(filepath.Join(dir, "args"))
+	require.NoError(t, err)
+	require.Equal(t, "compute instances stop dev\n", string(args))
+
+	// Another running session keeps the instance up.
+	other := sessionInfo{ID: "other", Host: "gcp:dev?shutdown=1h", PID: os.Getppid(), Started: time.Now()}
+	require.NoError(t, os.MkdirAll(filepath.Join(sessionsDir(), other.ID), 0700))
+	require.NoError(t, writeSession(other))
+
+	os.Remove(filepath.Join(dir, "args"))
+	require.NoError(t, h.stop())
+	require.False(t, pathExists(filepath.Join(dir, "args")))
+}
+
+func TestGCPHooksStart(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sshcode-gcp")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	defer installFakeGcloud(t, dir)()
+
+	// Resolving the host doesn't touch the instance, which is left to the
+	// start hook.
+	target, err := parseHost("gcp:--zone z dev?shutdown=2h")
+	require.NoError(t, err)
+	require.False(t, pathExists(filepath.Join(dir, "args")))
+	h, ok := target.hooks.(*gcpHooks)
+	require.True(t, ok)
+	require.Equal(t, 2*time.Hour, h.shutdownAfter)
+
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "status"), []byte("RUNNING\n"), 0644))
+	require.NoError(t, h.start())
+	host, sshFlags := h.address()
+	require.Equal(t, "dev@10.0.0.9", host)
+	require.Equal(t, "-t -i /keys/gce -o CheckHostIP=no", sshFlags)
+
+	// An instance started for a session that fails to connect is stopped
+	// again if the session would have stopped it.
+	os.Remove(filepath.Join(dir, "args"))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "status"), []byte("TERMINATED\n"), 0644))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "dry-run-fails"), nil, 0644))
+	h = &gcpHooks{args: []string{"dev"}, stopOnEnd: true}
+	err = h.start()
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "no route to instance")
+	args, err := ioutil.ReadFile(filepath.Join(dir, "args"))
+	require.NoError(t, err)
+	require.Contains(t, string(args), "compute instances start dev\n")
+	require.True(t, strings.HasSuffix(string(args), "compute instances stop dev\n"))
+}
+
+func TestGCPHooksShutdown(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sshcode-gcp")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	defer installFakeGcloud(t, dir)()
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "status"), []byte("RUNNING\n"), 0644))
+
+	scripts := filepath.Join(dir, "scripts")
+	h := &gcpHooks{args: []string{"dev"}, shutdownAfter: 90 * time.Minute, ssh: recordTransport{path: scripts}}
+	require.NoError(t, h.stop())
+	require.True(t, pathExists(h.shutdownMarker()))
+
+	// The next session cancels the shutdown.
+	require.NoError(t, h.start())
+	require.False(t, pathExists(h.shutdownMarker()))
+
+	b, err := ioutil.ReadFile(scripts)
+	require.NoError(t, err)
+	require.Equal(t, "sudo shutdown -h +90\nsudo shutdown -c\n", string(b))
+
+	// Without a marker, there's nothing to cancel.
+	require.NoError(t, h.start())
+	b, err = ioutil.ReadFile(scripts)
+	require.NoError(t, err)
+	require.Equal(t, "sudo shutdown -h +90\nsudo shutdown -c\n", string(b))
+
+	// An idle watcher is stopped instead.
+	require.NoError(t, os.Remove(scripts))
+	h = &gcpHooks{args: []string{"dev"}, idleAfter: 30 * time.Minute, ssh: recordTransport{path: scripts}}
+	require.NoError(t, h.stop())
+	require.NoError(t, h.start())
+	b, err = ioutil.ReadFile(scripts)
+	require.NoError(t, err)
+	require.True(t, strings.HasSuffix(string(b), "\n"+gcpCancelIdleScript+"\n"))
+	require.Contains(t, string(b), "-ge 30 ]")
+}
+
+func TestGCPIdleWatcher(t *testing.T) {
+	home, err := ioutil.TempDir("", "sshcode-gcp")
+	require.NoError(t, err)
+	defer os.RemoveAll(home)
+
+	// sudo records that the instance was shut down, and no one is logged in.
+	bin := filepath.Join(home, "bin")
+	require.NoError(t, os.MkdirAll(bin, 0700))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(bin, "sudo"), []byte("#!/bin/sh\nprintf '%s\\n' \"$*\" > \"$HOME/shutdown\"\n"), 0755))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(bin, "who"), []byte("#!/bin/sh\n"), 0755))
+	sleep, err := exec.LookPath("sleep")
+	require.NoError(t, err)
+	server := filepath.Join(home, ".cache", "sshcode", "sshcode-server")
+	require.NoError(t, os.MkdirAll(filepath.Dir(server), 0700))
+	require.NoError(t, os.Symlink(sleep, server))
+
+	run := func() {
+		cmd := exec.Command("sh", "-c", gcpIdleWatchScript(500*time.Millisecond, 100*time.Millisecond))
+		cmd.Env = []string{"HOME=" + home, "PATH=" + bin + string(os.PathListSeparator) + os.Getenv("PATH")}
+		out, err := cmd.CombinedOutput()
+		require.NoError(t, err, "%s", out)
+	}
+	waitShutdown := func(d time.Duration) bool {
+		for deadline := time.Now().Add(d); time.Now().Before(deadline); time.Sleep(50 * time.Millisecond) {
+			if pathExists(filepath.Join(home, "shutdown")) {
+				return true
+			}
+		}
+		return false
+	}
+
+	// A running code-server keeps the instance up.
+	codeServer := exec.Command(server, "2")
+	require.NoError(t, codeServer.Start())
+	run()
+	require.False(t, waitShutdown(time.Second))
+
+	// It's shut down once idle for long enough.
+	require.NoError(t, codeServer.Wait())
+	require.True(t, waitShutdown(3*time.Second))
+	b, err := ioutil.ReadFile(filepath.Join(home, "shutdown"))
+	require.NoError(t, err)
+	require.Equal(t, "-n shutdown -h now\n", string(b))
+	require.False(t, pathExists(filepath.Join(home, ".cache", "sshcode", "idle-watch.pid")))
+
+	// Cancelling stops the watcher.
+	require.NoError(t, os.Remove(filepath.Join(home, "shutdown")))
+	run()
+	cmd := exec.Command("sh", "-c", gcpCancelIdleScript)
+	cmd.Env = []string{"HOME=" + home}
+	require.NoError(t, cmd.Run())
+	require.False(t, waitShutdown(time.Second))
+}
@@ -3,6 +3,7 @@ module go.coder.com/sshcode
 go 1.12
 
 require (
+	github.com/fsnotify/fsnotify v1.4.7
 	github.com/pkg/browser v0.0.0-20180916011732-0a3d74bf9ce4
 	github.com/pkg/errors v0.8.1 // indirect
 	github.com/spf13/pflag v1.0.3
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+
+	"golang.org/x/xerrors"
+)
+
+// k8sProvider resolves running pods, given as
+// k8s:[CONTEXT/]NAMESPACE/POD[/CONTAINER], which are reached with kubectl
+// exec, cp and port-forward rather than ssh. Names are looked up in the
+// current context if none is given.
+type k8sProvider struct{}
+
+func (k8sProvider) resolve(addr string) (target, error) {
+	k, err := parseK8sAddr(addr)
+	if err != nil {
+		return target{}, err
+	}
+
+	out, err := k.kubectl("get", "pod", "--namespace", k.namespace, k.pod, "--output", "jsonpath={.status.phase}").Output()
+	if err != nil {
+		return target{}, xerrors.Errorf("failed to get pod %v: %v: %w", k.pod, commandStderr(err), err)
+	}
+	if phase := strings.TrimSpace(string(out)); phase != "Running" {
+		return target{}, xerrors.Errorf("pod %v is %v", k.pod, phase)
+	}
+
+	t := target{host: k.pod, transport: k}
+	return t, t.validate()
+}
+
+// parseK8sAddr parses [CONTEXT/]NAMESPACE/POD[/CONTAINER]. Contexts can
+// contain slashes, e.g. EKS cluster ARNs, so an address is only taken to start
+// with a context if it's one kubectl knows.
+func parseK8sAddr(addr string) (*k8sTransport, error) {
+	k := &k8sTransport{}
+	if strings.Count(addr, "/") >= 2 {
+		out, err := exec.Command("kubectl", "config", "get-contexts", "--output", "name").Output()
+		if err != nil {
+			return nil, xerrors.Errorf("failed to list contexts: %v: %w", commandStderr(err), err)
+		}
+		for _, context := range strings.Fields(string(out)) {
+			if strings.HasPrefix(addr, context+"/") && len(context) > len(k.context) {
+				k.context = context
+			}
+		}
+		if k.context != "" {
+			addr = strings.TrimPrefix(addr, k.context+"/")
+		}
+	}
+
+	toks := strings.Split(addr, "/")
+	switch len(toks) {
+	case 2:
+		k.namespace, k.pod = toks[0], toks[1]
+	case 3:
+		k.namespace, k.pod, k.container = toks[0], toks[1], toks[2]
+	default:
+		return nil, xerrors.New("expected k8s:[CONTEXT/]NAMESPACE/POD[/CONTAINER]")
+	}
+	for _, name := range toks {
+		if !safeSSHArg.MatchString(name) {
+			return nil, xerrors.Errorf("invalid name %q", name)
+		}
+	}
+	return k, nil
+}
+
+// k8sTransport runs commands in a pod's container with kubectl.
+type k8sTransport struct {
+	context   string
+	namespace string
+	pod       string
+	// container is the pod's default container if empty.
+	container string
+
+	// home is the home directory in the container, once looked up.
+	home string
+}
+
+// kubectl returns a kubectl command using the transport's context.
+func (k *k8sTransport) kubectl(args ...string) *exec.Cmd {
+	if k.context != "" {
+		args = append([]string{"--context", k.context}, args...)
+	}
+	return exec.Command("kubectl", args...)
+}
+
+// containerArgs returns the flags that select the container.
+func (k *k8sTransport) containerArgs() []string {
+	if k.container == "" {
+		return nil
+	}
+	return []string{"--container", k.container}
+}
+
+func (k *k8sTransport) command(script string) *exec.Cmd {
+	args := append([]string{"exec", "--stdin", "--namespace", k.namespace, k.pod}, k.containerArgs()...)
+	return k.kubectl(append(args, "--", "sh", "-c", script)...)
+}
+
+func (k *k8sTransport) copyTo(src, dst string) error {
+	info, err := os.Stat(src)
+	if err != nil {
+		return err
+	}
+	if dst == "~" || strings.HasPrefix(dst, "~/") {
+		// kubectl cp doesn't expand ~.
+		if k.home == "" {
+			out, err := k.command(`echo "$HOME"`).Output()
+			if err != nil {
+				return xerrors.Errorf("failed to find home directory in pod %v: %v: %w", k.pod, commandStderr(err), err)
+			}
+			k.home = strings.TrimSpace(string(out))
+		}
+		dst = k.home + dst[1:]
+	}
+
+	// Where kubectl cp puts a directory depends on whether the destination
+	// exists, so it's copied to a new one and moved into place.
+	copyDst, script := dst, fmt.Sprintf(`mkdir -p "%v"`, path.Dir(dst))
+	if info.IsDir() {
+		suffix, err := randomHex(4)
+		if err != nil {
+			return err
+		}
+		copyDst = dst + ".sshcode-" + suffix
+		script = fmt.Sprintf(`mkdir -p "%v"`, dst)
+	}
+	out, err := k.command(script).CombinedOutput()
+	if err != nil {
+		return xerrors.Errorf("failed to create %v: %s: %w", dst, out, err)
+	}
+
+	args := append([]string{"cp", src, k.namespace + "/" + k.pod + ":" + copyDst}, k.containerArgs()...)
+	out, err = k.kubectl(args...).CombinedOutput()
+	if err != nil {
+		return xerrors.Errorf("failed to copy %v to %v: %s: %w", src, dst, out, err)
+	}
+
+	if copyDst != dst {
+		script = fmt.Sprintf(`cp -R "%[1]v"/. "%[2]v"/ && rm -rf "%[1]v"`, copyDst, dst)
+		out, err = k.command(script).CombinedOutput()
+		if err != nil {
+			return xerrors.Errorf("failed to move %v into place: %s: %w", src, out, err)
+		}
+	}
+	return nil
+}
+
+func (k *k8sTransport) forwardPort(port, localAddr string, out io.Writer) (func(), error) {
+	host, localPort, err := net.SplitHostPort(localAddr)
+	if err != nil {
+		return nil, err
+	}
+	cmd := k.kubectl("port-forward", "--namespace", k.namespace, "pod/"+k.pod,
+		"--address", host, localPort+":"+port,
+	)
+	cmd.Stdout = out
+	cmd.Stderr = out
+	err = cmd.Start()
+	if err != nil {
+		return nil, xerrors.Errorf("failed to start kubectl port-forward: %w", err)
+	}
+	go cmd.Wait()
+	return func() { cmd.Process.Kill() }, nil
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// fakeKubectl answers config get-contexts, get pod and the home directory
+// lookup, and records its arguments.
+const fakeKubectl = `#!/bin/sh
+echo "$@" >> "$(dirname "$0")/args"
+case "$*" in
+*"config get-contexts"*)
+	printf 'dev\narn:aws:eks:us-east-1:123:cluster/prod\n'
+	;;
+*"get pod"*" web "*)
+	printf Running
+	;;
+*"get pod"*" pending "*)
+	printf Pending
+	;;
+*'echo "$HOME"'*)
+	echo /home/dev
+	;;
+esac
+`
+
+func TestK8sProvider(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sshcode-k8s")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	err = ioutil.WriteFile(filepath.Join(dir, "kubectl"), []byte(fakeKubectl), 0755)
+	require.NoError(t, err)
+	defer os.Setenv("PATH", os.Getenv("PATH"))
+	os.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	tcs := []struct {
+		host    string
+		want    k8sTransport
+		wantErr string
+	}{
+		{host: "k8s:default/web", want: k8sTransport{namespace: "default", pod: "web"}},
+		{host: "k8s:dev/default/web", want: k8sTransport{context: "dev", namespace: "default", pod: "web"}},
+		{host: "k8s:default/web/app", want: k8sTransport{namespace: "default", pod: "web", container: "app"}},
+		{
+			host: "k8s:arn:aws:eks:us-east-1:123:cluster/prod/default/web/app",
+			want: k8sTransport{context: "arn:aws:eks:us-east-1:123:cluster/prod", namespace: "default", pod: "web", container: "app"},
+		},
+		{host: "k8s:default/pending", wantErr: "pod pending is Pending"},
+		{host: "k8s:web", wantErr: "expected k8s:[CONTEXT/]NAMESPACE/POD[/CONTAINER]"},
+		{host: "k8s:other/default/web/app", wantErr: "expected k8s:"},
+	}
+	for _, tc := range tcs {
+		t.Run(tc.host, func(t *testing.T) {
+			target, err := parseHost(tc.host)
+			if tc.wantErr != "" {
+				require.Error(t, err)
+				require.Contains(t, err.Error(), tc.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, "web", target.destination())
+			require.Equal(t, &tc.want, target.transport)
+		})
+	}
+
+	k := &k8sTransport{context: "dev", namespace: "default", pod: "web", container: "app"}
+	require.Equal(t, []string{
+		"kubectl", "--context", "dev", "exec", "--stdin", "--namespace", "default", "web", "--container", "app",
+		"--", "sh", "-c", "echo hi",
+	}, k.command("echo hi").Args)
+
+	err = k.copyTo(filepath.Join(dir, "args"), "~/.cache/args")
+	require.NoError(t, err)
+	args, err := ioutil.ReadFile(filepath.Join(dir, "args"))
+	require.NoError(t, err)
+	require.Contains(t, string(args), "--context dev cp "+filepath.Join(dir, "args")+" default/web:/home/dev/.cache/args --container app\n")
+
+	// The rest of the pod can reach code-server's port, so it needs a password.
+	err = sshCode("k8s:default/web", "", options{skipSync: true, auth: authNone})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "--auth none isn't supported for k8s:default/web")
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"time"
+
+	"github.com/spf13/pflag"
+	"go.coder.com/cli"
+	"go.coder.com/flog"
+	"golang.org/x/xerrors"
+)
+
+// logsFollowInterval is how often a followed log is checked for new output.
+const logsFollowInterval = 500 * time.Millisecond
+
+// remoteLogTailLines is how many lines of a session's remote log are read.
+const remoteLogTailLines = 1000
+
+var _ interface {
+	cli.Command
+	cli.FlaggedCommand
+} = new(logsCmd)
+
+type logsCmd struct {
+	follow bool
+	remote bool
+}
+
+func (c *logsCmd) Spec() cli.CommandSpec {
+	return cli.CommandSpec{
+		Name:  "logs",
+		Usage: "[FLAGS] [SESSION]",
+		Desc: "Print the code-server output of a session, the latest one by default. " +
+			"If sshcode stopped before the session did, the rest of the output is read from the host.",
+	}
+}
+
+func (c *logsCmd) RegisterFlags(fl *pflag.FlagSet) {
+	fl.BoolVarP(&c.follow, "follow", "f", false, "keep printing new output until the session ends")
+	fl.BoolVar(&c.remote, "remote", false, "also print the output code-server wrote on the host after the local log ends")
+}
+
+func (c *logsCmd) Run(fl *pflag.FlagSet) {
+	s, err := findSession(fl.Arg(0))
+	if err != nil {
+		flog.Fatal("%v", err)
+	}
+
+	f, err := os.Open(sessionLogPath(s.ID))
+	if err != nil {
+		flog.Fatal("failed to open log: %v", err)
+	}
+	defer f.Close()
+
+	_, err = io.Copy(os.Stdout, f)
+	if err != nil {
+		flog.Fatal("failed to read log: %v", err)
+	}
+
+	for c.follow && s.running() {
+		time.Sleep(logsFollowInterval)
+		_, err = io.Copy(os.Stdout, f)
+		if err != nil {
+			flog.Fatal("failed to read log: %v", err)
+		}
+
+		s, err = readSession(s.ID)
+		if err != nil {
+			break
+		}
+		if !s.running() {
+			// Print whatever was written before it ended.
+			io.Copy(os.Stdout, f)
+		}
+	}
+
+	if !c.remote && !s.endedUncleanly() {
+		return
+	}
+	err = printRemoteLog(os.Stdout, s)
+	if err != nil {
+		flog.Fatal("%v", err)
+	}
+}
+
+// printRemoteLog prints what the session's code-server wrote to its log on
+// the host after the local log ends.
+func printRemoteLog(w io.Writer, s sessionInfo) error {
+	local, err := ioutil.ReadFile(sessionLogPath(s.ID))
+	if err != nil {
+		return xerrors.Errorf("failed to read log: %w", err)
+	}
+	remote, err := fetchRemoteLog(s)
+	if err != nil {
+		return err
+	}
+	rest := remoteLogAfter(local, remote)
+	if len(rest) == 0 {
+		return nil
+	}
+	fmt.Fprintf(w, "---output on %v after the local log ends, full log at %v---\n", s.Host, remoteLogPath(s.ID))
+	w.Write(rest)
+	fmt.Fprintln(w, "---")
+	return nil
+}
+
+// fetchRemoteLog returns the end of the session's log on its host.
+func fetchRemoteLog(s sessionInfo) ([]byte, error) {
+	var tr transport
+	if s.SSHHost != "" {
+		tr = sshTransport{sshFlags: s.SSHFlags, host: s.SSHHost}
+	} else {
+		t, err := parseHost(s.Host)
+		if err != nil {
+			return nil, xerrors.Errorf("failed to parse host: %w", err)
+		}
+		if t.transport == nil {
+			return nil, xerrors.Errorf("the session doesn't record how %v was reached", s.Host)
+		}
+		tr = t.transport
+	}
+
+	path := remoteLogPath(s.ID)
+	out, err := tr.command(fmt.Sprintf("tail -n %v %v", remoteLogTailLines, path)).Output()
+	if err != nil {
+		return nil, xerrors.Errorf("failed to read %v on %v: %v: %w", path, s.Host, commandStderr(err), err)
+	}
+	return out, nil
+}
+
+// remoteLogAfter returns the lines of the remote log after the last line it
+// shares with the local log, or all of it if they share none. The local log
+// also has ssh's output, so it may not end with a line of the remote one.
+func remoteLogAfter(local, remote []byte) []byte {
+	remoteLines := bytes.SplitAfter(remote, []byte("\n"))
+	last := make(map[string]int, len(remoteLines))
+	for i, line := range remoteLines {
+		last[string(bytes.TrimSpace(line))] = i
+	}
+
+	localLines := bytes.Split(local, []byte("\n"))
+	for i := len(localLines) - 1; i >= 0; i-- {
+		line := bytes.TrimSpace(localLines[i])
+		if len(line) == 0 {
+			continue
+		}
+		if j, ok := last[string(line)]; ok {
+			return bytes.Join(remoteLines[j+1:], nil)
+		}
+	}
+	return remote
+}
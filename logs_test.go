@@ -0,0 +1,19 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRemoteLogAfter(t *testing.T) {
+	remote := []byte("info  starting\ninfo  listening\nwarn  reconnecting\ninfo  shutting down\n")
+
+	// The local log ends with ssh's output after the last shared line.
+	local := []byte("info  starting\ninfo  listening\nConnection to dev closed by remote host.\n\n")
+	require.Equal(t, "warn  reconnecting\ninfo  shutting down\n", string(remoteLogAfter(local, remote)))
+
+	require.Empty(t, remoteLogAfter(remote, remote))
+	require.Equal(t, string(remote), string(remoteLogAfter([]byte("ssh: connect to host dev port 22\n"), remote)))
+	require.Equal(t, string(remote), string(remoteLogAfter(nil, remote)))
+}
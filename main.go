@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"math/rand"
 	"os"
+	"path/filepath"
 	"runtime"
 	"strings"
 	"time"
@@ -26,10 +27,46 @@ var (
 	version string
 )
 
+// subcommands are only recognized as the first argument, as any other
+// argument could be a host or directory of the same name. A host with the
+// name of a subcommand can be given after --, or as an ssh:// URI.
+var subcommands = []cli.Command{
+	&logsCmd{},
+	&sessionsCmd{},
+	&stopCmd{},
+}
+
 func main() {
+	if path := os.Getenv(askpassSocketEnv); path != "" {
+		// ssh runs sshcode as its askpass program in detached sessions, with
+		// the prompt as the only argument.
+		err := runAskpass(path, strings.Join(os.Args[1:], " "), os.Stdout)
+		if err != nil {
+			flog.Fatal("%v", err)
+		}
+		return
+	}
+	if cmd := findSubcommand(os.Args[1:]); cmd != nil {
+		cli.Run(cmd, os.Args[2:], "sshcode ")
+		return
+	}
 	cli.RunRoot(&rootCmd{})
 }
 
+// findSubcommand returns the subcommand args start with, or nil if they
+// start a session.
+func findSubcommand(args []string) cli.Command {
+	if len(args) == 0 {
+		return nil
+	}
+	for _, cmd := range subcommands {
+		if args[0] == cmd.Spec().Name {
+			return cmd
+		}
+	}
+	return nil
+}
+
 var _ interface {
 	cli.Command
 	cli.FlaggedCommand
@@ -39,10 +76,31 @@ type rootCmd struct {
 	skipSync          bool
 	syncBack          bool
 	printVersion      bool
+	printCA           bool
 	noReuseConnection bool
 	bindAddr          string
 	sshFlags          string
 	uploadCodeServer  string
+	sync              map[string]string
+	noScrub           bool
+	uploadUnscanned   bool
+	flavor            string
+	pushDir           string
+	syncBackInterval  time.Duration
+	forwards          []string
+	noAutoForward     bool
+	auth              string
+	share             bool
+	shareReadOnly     bool
+	tls               bool
+	cache             bool
+	startTimeout      time.Duration
+	browser           string
+	browserFlags      string
+	noAppMode         bool
+	noOpen            bool
+	detach            bool
+	printJSON         bool
 }
 
 func (c *rootCmd) Spec() cli.CommandSpec {
@@ -55,12 +113,33 @@ func (c *rootCmd) Spec() cli.CommandSpec {
 
 func (c *rootCmd) RegisterFlags(fl *pflag.FlagSet) {
 	fl.BoolVar(&c.skipSync, "skipsync", false, "skip syncing local settings and extensions to remote host")
-	fl.BoolVar(&c.syncBack, "b", false, "sync extensions back on termination")
+	fl.BoolVar(&c.syncBack, "b", false, "sync extensions back on termination (SSH hosts only)")
+	fl.DurationVar(&c.syncBackInterval, "sync-back-interval", 0, "also sync back periodically while the session runs, e.g. 10m (requires -b)")
+	fl.DurationVar(&c.startTimeout, "start-timeout", defaultStartTimeout, "how long to wait for code-server to start")
 	fl.BoolVar(&c.printVersion, "version", false, "print version information and exit")
+	fl.BoolVar(&c.printCA, "print-ca", false, "print the local CA certificate used by --tls, generating it if needed, and exit")
 	fl.BoolVar(&c.noReuseConnection, "no-reuse-connection", false, "do not reuse SSH connection via control socket")
-	fl.StringVar(&c.bindAddr, "bind", "", "local bind address for SSH tunnel, in [HOST][:PORT] syntax (default: 127.0.0.1)")
+	fl.StringVar(&c.auth, "auth", "", "code-server authentication: none, the default except for k8s: hosts, or password to generate a password for the session and log the browser in")
+	fl.BoolVar(&c.share, "share", false, "share the session on the network behind a one-time link, over HTTPS (binds 0.0.0.0 unless --bind has a host)")
+	fl.BoolVar(&c.shareReadOnly, "share-read-only", false, "with --share, only let the guest browse the workspace's files rather than use the editor")
+	fl.BoolVar(&c.tls, "tls", false, "serve the session over HTTPS with a certificate signed by a local CA")
+	fl.BoolVar(&c.cache, "cache", false, "serve the session through a local proxy that caches static assets and compresses responses, for high-latency links")
+	fl.StringVar(&c.bindAddr, "bind", "", "local bind address for SSH tunnel, in [HOST][:PORT] or unix:PATH syntax (default: 127.0.0.1)")
+	fl.StringArrayVarP(&c.forwards, "forward", "L", nil, "additionally forward a remote port or socket, in LOCAL:REMOTE syntax (e.g. 8080:3000 or /tmp/docker.sock:/var/run/docker.sock), repeatable (SSH hosts only)")
+	fl.BoolVar(&c.noAutoForward, "no-auto-forward", false, "do not forward ports that the session's processes start listening on")
+	fl.BoolVar(&c.noOpen, "no-open", false, "don't open the editor in a browser, only print its URL")
+	fl.BoolVar(&c.detach, "detach", false, "run the session in the background once it's ready, printing its ID and URL")
+	fl.BoolVar(&c.printJSON, "json", false, "print the ID and URL of a detached session as JSON")
+	fl.StringVar(&c.browser, "browser", "", "browser to open the editor in: "+strings.Join(browserNames(), ", ")+", or a command containing "+browserURLPlaceholder)
+	fl.StringVar(&c.browserFlags, "browser-flags", "", "additional flags to pass to the browser")
+	fl.BoolVar(&c.noAppMode, "no-app-mode", false, "open the editor in a regular browser window instead of an app window")
 	fl.StringVar(&c.sshFlags, "ssh-flags", "", "custom SSH flags")
+	fl.StringVar(&c.pushDir, "push", "", "mirror a local directory into the remote DIR and keep it in sync while the session runs (SSH hosts only)")
 	fl.StringVar(&c.uploadCodeServer, "upload-code-server", "", "custom code-server binary to upload to the remote host")
+	fl.StringVar(&c.flavor, "flavor", "", "VS Code flavor to sync from: "+strings.Join(flavorNames(), ", ")+" (default: detected)")
+	fl.BoolVar(&c.noScrub, "no-scrub", false, "do not scrub secrets from settings synced to the remote host")
+	fl.BoolVar(&c.uploadUnscanned, "upload-unscanned", false, "upload files in extension global storage that can't be scrubbed of secrets, such as state.vscdb, rather than holding them back")
+	fl.StringToStringVar(&c.sync, "sync", nil, "override what is synced, in CATEGORY=DIRECTION syntax (e.g. snippets=up,globalStorage/github.copilot=none)")
 }
 
 func (c *rootCmd) Run(fl *pflag.FlagSet) {
@@ -68,6 +147,10 @@ func (c *rootCmd) Run(fl *pflag.FlagSet) {
 		fmt.Printf("%v\n", version)
 		os.Exit(0)
 	}
+	if c.printCA {
+		printLocalCA()
+		os.Exit(0)
+	}
 
 	host := fl.Arg(0)
 	if host == "" {
@@ -76,23 +159,111 @@ func (c *rootCmd) Run(fl *pflag.FlagSet) {
 		os.Exit(1)
 	}
 
+	// The directory defaults to the home directory unless the host is a URI
+	// with a path.
 	dir := fl.Arg(1)
-	if dir == "" {
-		dir = "~"
-	}
 
 	// Get linux relative path if on windows.
-	if runtime.GOOS == "windows" {
+	if runtime.GOOS == "windows" && dir != "" {
 		dir = gitbashWindowsDir(dir)
 	}
 
-	err := sshCode(host, dir, options{
+	conf, err := loadConfig()
+	if err != nil {
+		flog.Fatal("failed to load config: %v", err)
+	}
+
+	spec := defaultSyncSpec()
+	err = spec.apply(conf.Sync)
+	if err != nil {
+		flog.Fatal("invalid sync config in %v: %v", configPath(), err)
+	}
+	err = spec.apply(c.sync)
+	if err != nil {
+		flog.Fatal("invalid --sync flag: %v", err)
+	}
+
+	if c.flavor == "" {
+		c.flavor = conf.Flavor
+	}
+
+	var forwards []forward
+	for _, s := range append(conf.Forwards, c.forwards...) {
+		f, err := parseForward(s)
+		if err != nil {
+			flog.Fatal("invalid forward: %v", err)
+		}
+		forwards = append(forwards, f)
+	}
+
+	browser := browserConfig{
+		name:      c.browser,
+		flags:     conf.BrowserFlags,
+		noAppMode: c.noAppMode,
+	}
+	if browser.name == "" {
+		browser.name = conf.Browser
+	}
+	if c.browserFlags != "" {
+		browser.flags = strings.Fields(c.browserFlags)
+	}
+	if conf.BrowserProfile != "" {
+		browser.profileDir = expandPath(conf.BrowserProfile)
+	}
+	err = browser.validate()
+	if err != nil {
+		flog.Fatal("invalid browser: %v", err)
+	}
+
+	sessionID := os.Getenv(detachedSessionEnv)
+	if c.detach && sessionID == "" {
+		err = runDetached(c.printJSON, c.noOpen, browser)
+		if err != nil {
+			flog.Fatal("error: %v", err)
+		}
+		return
+	}
+	var onReady func(readySession)
+	if sessionID != "" {
+		onReady = detachedReady()
+		// The process that started this one opens the browser.
+		c.noOpen = true
+		err = useAskpass(filepath.Join(sessionsDir(), sessionID, askpassSocket))
+		if err != nil {
+			flog.Fatal("error: %v", err)
+		}
+	}
+
+	var scrub *scrubber
+	if !c.noScrub {
+		scrub = newScrubber(conf.SecretKeys)
+		scrub.uploadUnscanned = c.uploadUnscanned
+	}
+
+	err = sshCode(host, dir, options{
 		skipSync:         c.skipSync,
 		sshFlags:         c.sshFlags,
 		bindAddr:         c.bindAddr,
 		syncBack:         c.syncBack,
 		reuseConnection:  !c.noReuseConnection,
 		uploadCodeServer: c.uploadCodeServer,
+		syncSpec:         spec,
+		scrubber:         scrub,
+		flavor:           c.flavor,
+		pushDir:          c.pushDir,
+		syncBackInterval: c.syncBackInterval,
+		forwards:         forwards,
+		autoForward:      !c.noAutoForward,
+		auth:             c.auth,
+		share:            c.share,
+		shareReadOnly:    c.shareReadOnly,
+		tls:              c.tls,
+		cache:            c.cache,
+		startTimeout:     c.startTimeout,
+		browser:          browser,
+		noOpen:           c.noOpen,
+		sessionID:        sessionID,
+		onReady:          onReady,
 	})
 
 	if err != nil {
@@ -110,14 +281,40 @@ func (c *rootCmd) description() string {
 Environment variables:
 %v%v use special VS Code settings dir.
 %v%v use special VS Code extensions dir.
+%v%v use a different sshcode config file (default: %v).
+
+Sync categories:
+%vsettings, keybindings, snippets, globalStorage, globalStorage/<extension-id>, profiles, other.
+%vEach is synced in one direction: both (default), up, down or none.
+
+Commands:
+%vlogs [-f] [--remote] [SESSION]  print the code-server output of a session.
+%vsessions [-a]                    list running sessions.
+%vstop SESSION                     stop a session.
+%vTo connect to a host named like a command, pass it after --, e.g. 'sshcode -- logs'.
 
 More info: https://github.com/cdr/sshcode
 
 Arguments:
-%vHOST is passed into the ssh command. Valid formats are '<ip-address>' or 'gcp:<instance-name>'.
-%vDIR is optional.`,
+%vHOST is passed into the ssh command. Valid formats are '<ip-address>', 'gcp:<instance-name>',
+%v'ssh://[user@]host[:port][/dir][?jump=host,...]' or 'gcp://<project>/<zone>/<instance>[/dir]'.
+%vHOST can also be '<provider>:<address>', resolved by a built-in provider (%v) or an
+%v'sshcode-provider-<provider>' executable on your PATH.
+%vSettings are only copied into docker: and k8s: hosts, which don't support -b, --push or --forward.
+%vDIR is optional and can't be combined with a HOST that has a dir. URI paths are absolute, start them with /~ for the home dir.`,
 		helpTab, vsCodeConfigDirEnv,
 		helpTab, vsCodeExtensionsDirEnv,
+		helpTab, sshcodeConfigEnv, configPath(),
+		helpTab,
+		helpTab,
+		helpTab,
+		helpTab,
+		helpTab,
+		helpTab,
+		helpTab,
+		helpTab,
+		helpTab, strings.Join(providerNames(), ", "),
+		helpTab,
 		helpTab,
 		helpTab,
 	)
@@ -0,0 +1,18 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestFindSubcommand(t *testing.T) {
+	require.Equal(t, "logs", findSubcommand([]string{"logs", "-f"}).Spec().Name)
+	require.Equal(t, "stop", findSubcommand([]string{"stop", "abc"}).Spec().Name)
+
+	// Anywhere else, and after --, it's a host or directory.
+	require.Nil(t, findSubcommand(nil))
+	require.Nil(t, findSubcommand([]string{"--", "logs"}))
+	require.Nil(t, findSubcommand([]string{"dev", "logs"}))
+	require.Nil(t, findSubcommand([]string{"ssh://logs"}))
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.coder.com/flog"
+	"golang.org/x/xerrors"
+)
+
+// portPollInterval is how often the remote host is polled for new ports.
+const portPollInterval = 2 * time.Second
+
+// listeningPortsScript prints, in hex, the TCP ports listened on by the
+// processes matching the pgrep pattern %[1]q and their descendants, other than
+// those whose command line contains %[2]q, which are code-server's own.
+const listeningPortsScript = `pids=$(ps -e -o pid= -o ppid= | awk -v roots="$(pgrep -f -- %[1]q | tr '\n' ' ')" '
+	BEGIN { n = split(roots, r, " "); for (i = 1; i <= n; i++) keep[r[i]] = 1 }
+	{ parent[$1] = $2 }
+	END {
+		do {
+			changed = 0
+			for (p in parent) if (!(p in keep) && (parent[p] in keep)) { keep[p] = 1; changed = 1 }
+		} while (changed)
+		for (p in keep) print p
+	}')
+inodes=$(for p in $pids; do grep -q -- %[2]q /proc/$p/cmdline 2>/dev/null || ls -l /proc/$p/fd 2>/dev/null; done | sed -n 's/.*socket:\[\([0-9]*\)\].*/\1/p' | tr '\n' ' ')
+cat /proc/net/tcp /proc/net/tcp6 2>/dev/null | awk -v inodes=" $inodes " '$4 == "0A" && index(inodes, " " $10 " ") { split($2, a, ":"); print a[2] }' | sort -u
+`
+
+// portWatcher forwards ports that the session's processes start listening on
+// through the SSH master connection.
+type portWatcher struct {
+	sshFlags string
+	host     string
+	// pattern matches the command line of the session's code-server.
+	pattern string
+	// serverName is in the command line of code-server's processes, whose
+	// internal ports aren't forwarded.
+	serverName string
+	// ignore are remote ports that are already forwarded.
+	ignore map[int]bool
+
+	// forwarded maps remote ports to the local address they're forwarded to.
+	forwarded map[int]string
+}
+
+// newPortWatcher returns a watcher for the session described by o, ignoring
+// the ports it already forwards.
+func newPortWatcher(o options, host, socketDir string) *portWatcher {
+	ignore := make(map[int]bool)
+	for _, addr := range forwardRemotes(o.forwards) {
+		host, port, ok := splitForwardAddr(addr)
+		if !ok || (host != "localhost" && host != "127.0.0.1") {
+			continue
+		}
+		p, err := strconv.Atoi(port)
+		if err == nil {
+			ignore[p] = true
+		}
+	}
+
+	return &portWatcher{
+		sshFlags:   o.sshFlags,
+		host:       host,
+		pattern:    fmt.Sprintf("%v.*--socket %v/", filepath.Base(codeServerPath), socketDir),
+		serverName: filepath.Base(codeServerPath),
+		ignore:     ignore,
+	}
+}
+
+// watch polls for listening ports until ctx is canceled, then cancels the
+// forwards it set up.
+func (w *portWatcher) watch(ctx context.Context) {
+	w.forwarded = make(map[int]string)
+	defer func() {
+		for port := range w.forwarded {
+			w.cancel(port)
+		}
+	}()
+
+	t := time.NewTicker(portPollInterval)
+	defer t.Stop()
+
+	for {
+		ports, err := w.listeningPorts(ctx)
+		if err == nil {
+			w.update(ports)
+		} else if ctx.Err() == nil {
+			flog.Error("failed to list remote ports: %v", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+	}
+}
+
+// update sets up forwards for new ports and cancels the ones for ports that
+// are no longer listened on.
+func (w *portWatcher) update(ports []int) {
+	listening := make(map[int]bool, len(ports))
+	for _, port := range ports {
+		listening[port] = true
+		if w.ignore[port] {
+			continue
+		}
+		if _, ok := w.forwarded[port]; ok {
+			continue
+		}
+
+		local, err := w.forward(port)
+		if err != nil {
+			flog.Error("failed to forward remote port %v: %v", port, err)
+			// Don't retry on every poll.
+			w.ignore[port] = true
+			continue
+		}
+		w.forwarded[port] = local
+		flog.Info("remote port %v is available at http://%v", port, local)
+	}
+
+	for port := range w.forwarded {
+		if !listening[port] {
+			w.cancel(port)
+			flog.Info("remote port %v closed", port)
+		}
+	}
+}
+
+// listeningPorts returns the TCP ports the session's processes listen on.
+func (w *portWatcher) listeningPorts(ctx context.Context) ([]int, error) {
+	sshCmdStr := fmt.Sprintf("ssh %v %v 'sh -s'", w.sshFlags, w.host)
+	cmd := exec.CommandContext(ctx, "sh", "-c", sshCmdStr)
+	cmd.Stdin = strings.NewReader(fmt.Sprintf(listeningPortsScript, w.pattern, w.serverName))
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, err
+	}
+	return parseHexPorts(out)
+}
+
+// parseHexPorts parses the output of listeningPortsScript.
+func parseHexPorts(out []byte) ([]int, error) {
+	var ports []int
+	sc := bufio.NewScanner(bytes.NewReader(out))
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" {
+			continue
+		}
+		port, err := strconv.ParseUint(line, 16, 16)
+		if err != nil {
+			return nil, xerrors.Errorf("unexpected port %q: %w", line, err)
+		}
+		ports = append(ports, int(port))
+	}
+	sort.Ints(ports)
+	return ports, sc.Err()
+}
+
+// forward forwards the remote port through the SSH master and returns the
+// local address it's available at. The same port is used locally if free.
+func (w *portWatcher) forward(port int) (string, error) {
+	local := net.JoinHostPort("127.0.0.1", strconv.Itoa(port))
+	l, err := net.Listen("tcp", local)
+	if err == nil {
+		l.Close()
+	} else {
+		p, err := randomPort()
+		if err != nil {
+			return "", err
+		}
+		local = net.JoinHostPort("127.0.0.1", p)
+	}
+
+	err = w.control("forward", local, port)
+	if err != nil {
+		return "", err
+	}
+	return local, nil
+}
+
+// cancel removes the forward for port.
+func (w *portWatcher) cancel(port int) {
+	err := w.control("cancel", w.forwarded[port], port)
+	if err != nil {
+		flog.Error("failed to cancel forward of remote port %v: %v", port, err)
+	}
+	delete(w.forwarded, port)
+}
+
+// control sends a forward or cancel request to the SSH master.
+func (w *portWatcher) control(op, local string, port int) error {
+	sshCmdStr := fmt.Sprintf("ssh %v -O %v -L %v:localhost:%v %v", w.sshFlags, op, local, port, w.host)
+	out, err := exec.Command("sh", "-c", sshCmdStr).CombinedOutput()
+	if err != nil {
+		return xerrors.Errorf("%s: %w", bytes.TrimSpace(out), err)
+	}
+	return nil
+}
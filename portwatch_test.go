@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// fakePortSSH reports ports 3000 and 8080 as listening, and records the
+// arguments of control requests.
+const fakePortSSH = `#!/bin/sh
+case "$*" in
+*"-O "*)
+	echo "$@" >> "$(dirname "$0")/args"
+	;;
+*)
+	cat > /dev/null
+	printf '0BB8\n1F90\n'
+	;;
+esac
+`
+
+func TestParseHexPorts(t *testing.T) {
+	ports, err := parseHexPorts([]byte("1F90\n0BB8\n\n"))
+	require.NoError(t, err)
+	require.Equal(t, []int{3000, 8080}, ports)
+
+	_, err = parseHexPorts([]byte("1F90\nnope\n"))
+	require.Error(t, err)
+}
+
+func TestPortWatcher(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sshcode-portwatch")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	err = ioutil.WriteFile(filepath.Join(dir, "ssh"), []byte(fakePortSSH), 0755)
+	require.NoError(t, err)
+	defer os.Setenv("PATH", os.Getenv("PATH"))
+	os.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	forwards := []forward{
+		{local: "127.0.0.1:3000", remote: "localhost:3000"},
+		{local: "127.0.0.1:5432", remote: "db:5432"},
+	}
+	w := newPortWatcher(options{forwards: forwards}, "dev", "/tmp/sshcode-abc")
+	require.Equal(t, map[int]bool{3000: true}, w.ignore)
+	require.Equal(t, "sshcode-server.*--socket /tmp/sshcode-abc/", w.pattern)
+
+	ports, err := w.listeningPorts(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, []int{3000, 8080}, ports)
+
+	// 3000 is already forwarded, so only 8080 is.
+	w.forwarded = make(map[int]string)
+	w.update(ports)
+	require.Len(t, w.forwarded, 1)
+	local := w.forwarded[8080]
+	require.NotEmpty(t, local)
+
+	// Polling again doesn't forward it twice, and it's cancelled once it's
+	// closed.
+	w.update(ports)
+	w.update([]int{3000})
+	require.Empty(t, w.forwarded)
+
+	args, err := ioutil.ReadFile(filepath.Join(dir, "args"))
+	require.NoError(t, err)
+	require.Equal(t, []string{
+		"-O forward -L " + local + ":localhost:8080 dev",
+		"-O cancel -L " + local + ":localhost:8080 dev",
+	}, strings.Split(strings.TrimSpace(string(args)), "\n"))
+}
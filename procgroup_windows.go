@@ -0,0 +1,22 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+	"strconv"
+	"syscall"
+)
+
+func groupSysProcAttr() *syscall.SysProcAttr {
+	return nil
+}
+
+// killGroup kills p and its children, which Windows tracks by parent rather
+// than by group.
+func killGroup(p *os.Process) error {
+	err := exec.Command("taskkill", "/T", "/F", "/PID", strconv.Itoa(p.Pid)).Run()
+	if err != nil {
+		return p.Kill()
+	}
+	return nil
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"os/exec"
+	"regexp"
+	"sort"
+	"strings"
+
+	"golang.org/x/xerrors"
+)
+
+// externalProviderPrefix is the prefix of executables that provide targets.
+// sshcode-provider-NAME handles hosts given as NAME:ADDR.
+const externalProviderPrefix = "sshcode-provider-"
+
+// provider resolves the address in a NAME:ADDR host to a target.
+type provider interface {
+	resolve(addr string) (target, error)
+}
+
+// sessionHooks are run around a session by targets that need to be set up
+// and torn down, e.g. by starting a stopped instance.
+type sessionHooks interface {
+	// start runs before anything connects to the target.
+	start() error
+	// stop runs once the session ends.
+	stop() error
+}
+
+// addresser is implemented by session hooks that only know the target's
+// address once they've started it, e.g. as a cloud instance's address changes
+// when it's started. It's asked for the address after start.
+type addresser interface {
+	address() (host, sshFlags string)
+}
+
+// providers are the built-in providers.
+var providers = map[string]provider{
+	"ssh":    sshProvider{},
+	"gcp":    gcpProvider{},
+	"aws":    awsProvider{},
+	"azure":  azureProvider{},
+	"docker": dockerProvider{},
+	"k8s":    k8sProvider{},
+}
+
+// providerName matches the names of providers.
+var providerName = regexp.MustCompile(`^[a-z][a-z0-9-]*$`)
+
+// findProvider returns the built-in or external provider called name.
+func findProvider(name string) (provider, bool) {
+	if p, ok := providers[name]; ok {
+		return p, true
+	}
+	path, err := exec.LookPath(externalProviderPrefix + name)
+	if err != nil {
+		return nil, false
+	}
+	return externalProvider{path: path}, true
+}
+
+// providerNames returns the names of the built-in providers.
+func providerNames() []string {
+	var names []string
+	for name := range providers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// parseHost parses the host argument. Hosts in NAME:ADDR syntax are resolved
+// by the provider called NAME, e.g. 'gcp:' looks up the external IP and any
+// additional SSH arguments of an instance using gcloud. Other hosts are
+// passed to ssh as they are.
+func parseHost(host string) (target, error) {
+	host = strings.TrimSpace(host)
+
+	i := strings.Index(host, ":")
+	if i < 0 || !providerName.MatchString(host[:i]) {
+		return target{host: host}, nil
+	}
+	p, ok := findProvider(host[:i])
+	if !ok {
+		return target{host: host}, nil
+	}
+
+	t, err := p.resolve(host[i+1:])
+	if err != nil {
+		return target{}, xerrors.Errorf("failed to resolve %v: %w", host, err)
+	}
+	return t, nil
+}
+
+// sshProvider resolves ssh:// URIs.
+type sshProvider struct{}
+
+func (sshProvider) resolve(addr string) (target, error) {
+	if !strings.HasPrefix(addr, "//") {
+		return target{}, xerrors.New("expected ssh://[USER@]HOST[:PORT][/DIR]")
+	}
+	return parseSSHURI("ssh:" + addr)
+}
+
+// externalProvider runs an executable to resolve targets. It's run as
+//
+//	sshcode-provider-NAME resolve ADDR
+//
+// and prints the target as an externalTarget in JSON. If the target lists
+// hooks, it's run the same way with the hook's name instead of resolve before
+// the session starts and after it ends.
+type externalProvider struct {
+	path string
+}
+
+// externalTarget is what external providers print.
+type externalTarget struct {
+	Host      string   `json:"host"`
+	User      string   `json:"user"`
+	Port      string   `json:"port"`
+	JumpHosts []string `json:"jumpHosts"`
+	Dir       string   `json:"dir"`
+	SSHFlags  string   `json:"sshFlags"`
+	// Hooks are the session hooks the provider implements, start and stop.
+	Hooks []string `json:"hooks"`
+}
+
+func (p externalProvider) resolve(addr string) (target, error) {
+	out, err := p.run("resolve", addr)
+	if err != nil {
+		return target{}, err
+	}
+
+	var ext externalTarget
+	err = json.Unmarshal(out, &ext)
+	if err != nil {
+		return target{}, xerrors.Errorf("failed to parse output of %v: %w", p.path, err)
+	}
+	t := target{
+		user:      ext.User,
+		host:      ext.Host,
+		port:      ext.Port,
+		jumpHosts: ext.JumpHosts,
+		dir:       ext.Dir,
+		sshFlags:  ext.SSHFlags,
+	}
+	err = t.validate()
+	if err == nil {
+		err = validateSSHFlags(t.sshFlags)
+	}
+	if err != nil {
+		return target{}, xerrors.Errorf("%v returned an invalid target: %w", p.path, err)
+	}
+	if len(ext.Hooks) > 0 {
+		hooks := &externalHooks{p: p, addr: addr}
+		for _, hook := range ext.Hooks {
+			switch hook {
+			case "start":
+				hooks.hasStart = true
+			case "stop":
+				hooks.hasStop = true
+			default:
+				return target{}, xerrors.Errorf("%v returned unknown hook %q", p.path, hook)
+			}
+		}
+		t.hooks = hooks
+	}
+	return t, nil
+}
+
+// run runs the provider with args and returns what it printed. What it
+// prints to stderr is shown to the user, and it can prompt for input.
+func (p externalProvider) run(args ...string) ([]byte, error) {
+	var stdout bytes.Buffer
+	cmd := exec.Command(p.path, args...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = &stdout
+	cmd.Stderr = os.Stderr
+	err := cmd.Run()
+	if err != nil {
+		return nil, xerrors.Errorf("%v %v failed: %w", p.path, args[0], err)
+	}
+	return stdout.Bytes(), nil
+}
+
+// externalHooks runs the hooks an external provider implements.
+type externalHooks struct {
+	p        externalProvider
+	addr     string
+	hasStart bool
+	hasStop  bool
+}
+
+func (h *externalHooks) start() error {
+	if !h.hasStart {
+		return nil
+	}
+	_, err := h.p.run("start", h.addr)
+	return err
+}
+
+func (h *externalHooks) stop() error {
+	if !h.hasStop {
+		return nil
+	}
+	_, err := h.p.run("stop", h.addr)
+	return err
+}
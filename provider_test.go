@@ -0,0 +1,65 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// fakeProvider is an external provider that records the hooks run.
+const fakeProvider = `#!/bin/sh
+case "$1" in
+resolve)
+	case "$2" in
+	bad) echo '{"host": "dev; rm -rf ~"}' ;;
+	baddir) echo '{"host": "dev", "dir": "/srv/$(rm -rf ~)"}' ;;
+	badflags) echo '{"host": "dev", "sshFlags": "-i ~/.ssh/team; rm -rf ~"}' ;;
+	*) echo '{"host": "10.0.0.5", "user": "ubuntu", "port": "2222", "dir": "/srv/'"$2"'", "sshFlags": "-i ~/.ssh/team", "hooks": ["start", "stop"]}' ;;
+	esac
+	;;
+start|stop)
+	echo "$1 $2" >> "$(dirname "$0")/hooks"
+	;;
+*)
+	exit 1
+	;;
+esac
+`
+
+func TestExternalProvider(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sshcode-provider")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	err = ioutil.WriteFile(filepath.Join(dir, externalProviderPrefix+"inventory"), []byte(fakeProvider), 0755)
+	require.NoError(t, err)
+
+	defer os.Setenv("PATH", os.Getenv("PATH"))
+	os.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	target, err := parseHost("inventory:app")
+	require.NoError(t, err)
+	require.Equal(t, "ubuntu@10.0.0.5", target.destination())
+	require.Equal(t, "-p 2222 -i ~/.ssh/team", target.flags())
+	require.Equal(t, "/srv/app", target.dir)
+
+	require.NotNil(t, target.hooks)
+	require.NoError(t, target.hooks.start())
+	require.NoError(t, target.hooks.stop())
+	hooks, err := ioutil.ReadFile(filepath.Join(dir, "hooks"))
+	require.NoError(t, err)
+	require.Equal(t, "start app\nstop app\n", string(hooks))
+
+	for _, addr := range []string{"bad", "baddir", "badflags"} {
+		_, err = parseHost("inventory:" + addr)
+		require.Error(t, err, addr)
+	}
+
+	// Hosts with a colon that don't name a provider are passed through.
+	target, err = parseHost("unknown:app")
+	require.NoError(t, err)
+	require.Equal(t, "unknown:app", target.destination())
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"crypto/tls"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"go.coder.com/flog"
+	"golang.org/x/xerrors"
+)
+
+// tunnelSocket is the name of the local socket the SSH tunnel is bound to
+// when a local proxy serves the bind address.
+const tunnelSocket = "tunnel.sock"
+
+// newTunnelProxy returns a reverse proxy to code-server behind the tunnel
+// bound at tunnelAddr. WebSocket connections are passed through.
+func newTunnelProxy(tunnelAddr string) (*httputil.ReverseProxy, error) {
+	rawURL, client := bindClient(tunnelAddr, 0)
+	target, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+
+	p := httputil.NewSingleHostReverseProxy(target)
+	p.Transport = client.Transport
+	return p, nil
+}
+
+// serveProxy serves h on bindAddr in the background, over TLS if tlsConfig
+// isn't nil. The returned function stops the server.
+func serveProxy(bindAddr string, h http.Handler, tlsConfig *tls.Config) (func(), error) {
+	network, addr := "tcp", bindAddr
+	if path, ok := bindSocketPath(bindAddr); ok {
+		network, addr = "unix", path
+		// Replace a socket left behind by a previous session.
+		os.Remove(path)
+	}
+	l, err := net.Listen(network, addr)
+	if err != nil {
+		return nil, xerrors.Errorf("failed to listen on %v: %w", bindAddr, err)
+	}
+	if tlsConfig != nil {
+		l = tls.NewListener(l, tlsConfig)
+	}
+
+	srv := &http.Server{
+		Handler:           h,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	go func() {
+		err := srv.Serve(l)
+		if err != nil && err != http.ErrServerClosed {
+			flog.Error("local proxy stopped: %v", err)
+		}
+	}()
+	return func() { srv.Close() }, nil
+}
+
+// isWebSocketUpgrade reports whether r asks to upgrade to a WebSocket.
+func isWebSocketUpgrade(r *http.Request) bool {
+	return strings.EqualFold(r.Header.Get("Upgrade"), "websocket")
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"go.coder.com/flog"
+	"golang.org/x/xerrors"
+)
+
+var errPushHome = xerrors.New("--push needs a remote DIR other than the home or root directory")
+
+// pushDebounce is how long the local directory has to be quiet before changes
+// are pushed.
+const pushDebounce = 300 * time.Millisecond
+
+// pushFilters makes rsync skip the git directory and honor .gitignore files.
+var pushFilters = []string{"- .git/", ":- .gitignore"}
+
+// homeDirPath matches the usual locations of home directories.
+var homeDirPath = regexp.MustCompile(`^(/home|/Users)(/[^/]+)?$|^/root$|^/var/root$`)
+
+// resolvePushDir checks that localDir can be pushed to remoteDir and returns
+// its absolute path.
+func resolvePushDir(localDir, remoteDir string) (string, error) {
+	localDir, err := filepath.Abs(expandPath(localDir))
+	if err != nil {
+		return "", xerrors.Errorf("failed to resolve push directory: %w", err)
+	}
+	info, err := os.Stat(localDir)
+	if err != nil {
+		return "", xerrors.Errorf("failed to stat push directory: %w", err)
+	}
+	if !info.IsDir() {
+		return "", xerrors.Errorf("push directory %v is not a directory", localDir)
+	}
+	// The remote directory is mirrored, so anything else in it is deleted.
+	// pushDir also checks on the host, as only it knows its home directory.
+	remoteDir = path.Clean(remoteDir)
+	switch remoteDir {
+	case ".", "~", "/", "$HOME", "${HOME}":
+		return "", errPushHome
+	}
+	if homeDirPath.MatchString(remoteDir) || strings.HasPrefix(remoteDir, "~") && !strings.HasPrefix(remoteDir, "~/") {
+		return "", errPushHome
+	}
+	return localDir, nil
+}
+
+// pushDirScript creates the directory %[1]v and exits with status 3 if it's
+// the home or root directory.
+const pushDirScript = `mkdir -p %[1]v && cd %[1]v || exit
+dir=$(pwd -P)
+[ "$dir" != / ] && [ "$dir" != "$(cd && pwd -P)" ] || exit 3`
+
+// pushDir mirrors localDir into remoteDir on host.
+func pushDir(sshFlags, host, localDir, remoteDir string) error {
+	script := fmt.Sprintf(pushDirScript, shellQuotePath(remoteDir))
+	sshCmdStr := fmt.Sprintf("ssh %v %v %v", sshFlags, host, shellQuote(script))
+	out, err := exec.Command("sh", "-l", "-c", sshCmdStr).CombinedOutput()
+	var exitErr *exec.ExitError
+	if xerrors.As(err, &exitErr) && exitErr.ExitCode() == 3 {
+		return errPushHome
+	}
+	if err != nil {
+		return xerrors.Errorf("failed to create %v: %s: %w", remoteDir, out, err)
+	}
+
+	return rsync(localDir+"/", host+":"+remoteDir+"/", sshFlags, pushFilters...)
+}
+
+// watchPushDir pushes localDir to remoteDir every time something changes in it
+// until ctx is canceled.
+func watchPushDir(ctx context.Context, sshFlags, host, localDir, remoteDir string) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return xerrors.Errorf("failed to create file watcher: %w", err)
+	}
+	defer watcher.Close()
+
+	ignored := gitIgnoredDirs(localDir)
+	watchTree := func(root string) error {
+		return filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				// The directory may have been removed since the event fired.
+				return nil
+			}
+			if !info.IsDir() {
+				return nil
+			}
+			if info.Name() == ".git" || ignored[path] {
+				return filepath.SkipDir
+			}
+			return watcher.Add(path)
+		})
+	}
+	err = watchTree(localDir)
+	if err != nil {
+		return xerrors.Errorf("failed to watch %v: %w", localDir, err)
+	}
+
+	var (
+		timer   = time.NewTimer(pushDebounce)
+		pending bool
+	)
+	timer.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case ev, ok := <-watcher.Events:
+			if !ok {
+				return nil
+			}
+			if ev.Op&fsnotify.Create != 0 {
+				info, err := os.Stat(ev.Name)
+				if err == nil && info.IsDir() {
+					err = watchTree(ev.Name)
+					if err != nil {
+						flog.Error("failed to watch %v: %v", ev.Name, err)
+					}
+				}
+			}
+			if !pending {
+				pending = true
+			} else if !timer.Stop() {
+				<-timer.C
+			}
+			timer.Reset(pushDebounce)
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return nil
+			}
+			flog.Error("file watcher: %v", err)
+		case <-timer.C:
+			pending = false
+			start := time.Now()
+			// Only the first push mirrors, so files created on the host
+			// since, such as build output, aren't deleted.
+			err := rsyncUpdate(localDir+"/", host+":"+remoteDir+"/", sshFlags, pushFilters...)
+			if err != nil {
+				flog.Error("failed to push %v: %v", localDir, err)
+				continue
+			}
+			flog.Info("pushed %v in %s", localDir, time.Since(start))
+		}
+	}
+}
+
+// gitIgnoredDirs returns the directories in dir that git ignores, so they
+// aren't watched. It returns an empty set if dir isn't in a git repository.
+func gitIgnoredDirs(dir string) map[string]bool {
+	ignored := make(map[string]bool)
+
+	cmd := exec.Command("git", "ls-files", "--others", "--ignored", "--exclude-standard", "--directory")
+	cmd.Dir = dir
+	out, err := cmd.Output()
+	if err != nil {
+		return ignored
+	}
+
+	sc := bufio.NewScanner(bytes.NewReader(out))
+	for sc.Scan() {
+		line := sc.Text()
+		if strings.HasSuffix(line, "/") {
+			ignored[filepath.Join(dir, filepath.FromSlash(line))] = true
+		}
+	}
+	return ignored
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestResolvePushDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sshcode-push")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	got, err := resolvePushDir(dir, "~/src")
+	require.NoError(t, err)
+	require.Equal(t, dir, got)
+
+	for _, remoteDir := range []string{"", "~", "~/", "/", "//", "$HOME", "${HOME}/", "~kyle", "/home/kyle", "/home/kyle/", "/Users/kyle", "/root"} {
+		_, err = resolvePushDir(dir, remoteDir)
+		require.Error(t, err, "%q", remoteDir)
+	}
+
+	file := filepath.Join(dir, "file")
+	require.NoError(t, ioutil.WriteFile(file, nil, 0600))
+	_, err = resolvePushDir(file, "~/src")
+	require.Error(t, err)
+}
+
+func TestPushDirScript(t *testing.T) {
+	home, err := ioutil.TempDir("", "sshcode-push")
+	require.NoError(t, err)
+	defer os.RemoveAll(home)
+
+	run := func(remoteDir string) error {
+		cmd := exec.Command("sh", "-c", fmt.Sprintf(pushDirScript, shellQuotePath(remoteDir)))
+		cmd.Env = []string{"HOME=" + home}
+		return cmd.Run()
+	}
+
+	require.NoError(t, run("~/src/it's here"))
+	require.True(t, pathExists(filepath.Join(home, "src", "it's here")))
+
+	// The home directory is refused however it's spelled.
+	require.NoError(t, os.Symlink(home, filepath.Join(home, "link")))
+	for _, remoteDir := range []string{"~/link", home + "/src/..", "/"} {
+		err = run(remoteDir)
+		exitErr, ok := err.(*exec.ExitError)
+		require.True(t, ok, "%q: %v", remoteDir, err)
+		require.Equal(t, 3, exitErr.ExitCode(), remoteDir)
+	}
+
+	// Nothing is run from the path.
+	require.NoError(t, run("~/$(touch pwned)"))
+	require.False(t, pathExists(filepath.Join(home, "pwned")))
+}
+
+func TestGitIgnoredDirs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sshcode-push")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	require.Empty(t, gitIgnoredDirs(dir))
+
+	require.NoError(t, exec.Command("git", "init", "-q", dir).Run())
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, ".gitignore"), []byte("node_modules/\n*.log\n"), 0600))
+	for _, d := range []string{"node_modules/left-pad", "src"} {
+		require.NoError(t, os.MkdirAll(filepath.Join(dir, filepath.FromSlash(d)), 0700))
+	}
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "node_modules", "left-pad", "index.js"), nil, 0600))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "src", "main.go"), nil, 0600))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "src", "debug.log"), nil, 0600))
+
+	require.Equal(t, map[string]bool{filepath.Join(dir, "node_modules"): true}, gitIgnoredDirs(dir))
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"os/exec"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"go.coder.com/retry"
+	"golang.org/x/xerrors"
+)
+
+// defaultStartTimeout is how long code-server has to start by default.
+const defaultStartTimeout = 30 * time.Second
+
+// sshFailedStatus is the status ssh exits with when it fails itself, rather
+// than relaying the status of the remote command.
+const sshFailedStatus = 255
+
+// startupTailLines is how many lines of output are kept to explain failures.
+const startupTailLines = 20
+
+// listeningLine matches the line code-server prints once it accepts
+// connections.
+var listeningLine = regexp.MustCompile(`(?i)listening on|server listening`)
+
+// startupWatcher is written code-server's output over the tunnel and keeps
+// track of whether it started listening along with the last lines it printed.
+type startupWatcher struct {
+	mu        sync.Mutex
+	partial   string
+	lines     []string
+	listening bool
+}
+
+func (w *startupWatcher) Write(b []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	s := w.partial + string(b)
+	lines := strings.Split(s, "\n")
+	w.partial = lines[len(lines)-1]
+	for _, line := range lines[:len(lines)-1] {
+		line = strings.TrimRight(line, "\r")
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		if listeningLine.MatchString(line) {
+			w.listening = true
+		}
+		w.lines = append(w.lines, line)
+		if len(w.lines) > startupTailLines {
+			w.lines = w.lines[1:]
+		}
+	}
+	return len(b), nil
+}
+
+// sawListening reports whether code-server said it's listening.
+func (w *startupWatcher) sawListening() bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.listening
+}
+
+// tail returns the last lines of output.
+func (w *startupWatcher) tail() []string {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	lines := append([]string(nil), w.lines...)
+	if strings.TrimSpace(w.partial) != "" {
+		lines = append(lines, strings.TrimRight(w.partial, "\r"))
+	}
+	return lines
+}
+
+// waitReady waits until code-server responds at url, backing off between
+// attempts. It fails early if the tunnel exits, with an error that tells an
+// SSH failure apart from code-server exiting, and otherwise once ctx is done.
+func waitReady(ctx context.Context, client *http.Client, url string, exited <-chan error, out *startupWatcher) error {
+	backoff := &retry.Backoff{
+		Floor: 50 * time.Millisecond,
+		Ceil:  time.Second,
+	}
+
+	for {
+		select {
+		case err := <-exited:
+			return startFailure(err, out)
+		default:
+		}
+
+		resp, err := client.Get(url)
+		if err == nil {
+			resp.Body.Close()
+			return nil
+		}
+
+		err = backoff.Wait(ctx)
+		if err != nil {
+			if out.sawListening() {
+				return xerrors.New("code-server said it's listening but didn't respond through the tunnel in time")
+			}
+			return xerrors.New("code-server is still starting, pass a longer --start-timeout to wait for it")
+		}
+	}
+}
+
+// startFailure explains why the tunnel exited with err before code-server
+// was ready.
+func startFailure(err error, out *startupWatcher) error {
+	detail := ""
+	if tail := out.tail(); len(tail) > 0 {
+		detail = ", last output: " + tail[len(tail)-1]
+	}
+
+	var exitErr *exec.ExitError
+	switch {
+	case err == nil:
+		return xerrors.Errorf("code-server exited before it was ready%v", detail)
+	case xerrors.As(err, &exitErr) && exitErr.ExitCode() == sshFailedStatus:
+		return xerrors.Errorf("ssh failed to connect or set up the tunnel%v", detail)
+	case xerrors.As(err, &exitErr):
+		return xerrors.Errorf("code-server crashed with exit status %v%v", exitErr.ExitCode(), detail)
+	default:
+		return xerrors.Errorf("tunnel exited before code-server was ready: %w", err)
+	}
+}
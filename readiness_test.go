@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os/exec"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestStartupWatcher(t *testing.T) {
+	w := &startupWatcher{}
+	fmt.Fprint(w, "INFO  Starting webserver\r\nINFO  Server listen")
+	require.False(t, w.sawListening())
+	fmt.Fprint(w, "ing on /tmp/sshcode-1/code-server.sock\r\n\r\npartial")
+	require.True(t, w.sawListening())
+	require.Equal(t, []string{
+		"INFO  Starting webserver",
+		"INFO  Server listening on /tmp/sshcode-1/code-server.sock",
+		"partial",
+	}, w.tail())
+}
+
+func TestWaitReady(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer srv.Close()
+
+	exitErr := func(status int) error {
+		return exec.Command("sh", "-c", fmt.Sprintf("exit %v", status)).Run()
+	}
+
+	tcs := []struct {
+		name    string
+		url     string
+		exited  error
+		exit    bool
+		output  string
+		wantErr string
+	}{
+		{name: "ready", url: srv.URL},
+		{name: "ssh failed", url: "http://127.0.0.1:1", exit: true, exited: exitErr(255), output: "Connection refused\n", wantErr: "ssh failed to connect or set up the tunnel, last output: Connection refused"},
+		{name: "crashed", url: "http://127.0.0.1:1", exit: true, exited: exitErr(1), wantErr: "code-server crashed with exit status 1"},
+		{name: "exited", url: "http://127.0.0.1:1", exit: true, wantErr: "code-server exited before it was ready"},
+		{name: "starting", url: "http://127.0.0.1:1", wantErr: "code-server is still starting"},
+		{name: "not reachable", url: "http://127.0.0.1:1", output: "Server listening on /tmp/s\n", wantErr: "didn't respond through the tunnel"},
+	}
+
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			exited := make(chan error, 1)
+			if tc.exit {
+				exited <- tc.exited
+			}
+			out := &startupWatcher{}
+			fmt.Fprint(out, tc.output)
+
+			ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+			defer cancel()
+			err := waitReady(ctx, &http.Client{Timeout: time.Second}, tc.url, exited, out)
+			if tc.wantErr == "" {
+				require.NoError(t, err)
+				return
+			}
+			require.Error(t, err)
+			require.Contains(t, err.Error(), tc.wantErr)
+		})
+	}
+}
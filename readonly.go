@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"net/http"
+	"path"
+	"strings"
+
+	"go.coder.com/flog"
+)
+
+// readOnlyMaxFileSize is how much of a file read-only guests are shown.
+const readOnlyMaxFileSize = 1 << 20
+
+// readOnlyScript prints "d" and the entries of the directory, or "f" and the
+// start of the file, at the path %[2]v relative to the workspace %[1]v. It
+// exits with status 2 if the path doesn't exist or leads out of the
+// workspace, e.g. through a symlink.
+const readOnlyScript = `cd %[1]v 2>/dev/null || exit 2
+root=$(pwd -P)
+p=$(realpath -e -- %[2]v 2>/dev/null) || exit 2
+case "$p/" in "$root"/*) ;; *) exit 2 ;; esac
+if [ -d "$p" ]; then
+	echo d
+	ls -1Ap -- "$p"
+else
+	echo f
+	head -c %[3]v -- "$p"
+fi`
+
+// readOnlyView serves a read-only view of the files in the workspace dir on
+// the target reached with tr, for guests of a read-only share. code-server
+// has no read-only mode, so they're never let through to it.
+type readOnlyView struct {
+	tr  transport
+	dir string
+}
+
+var readOnlyListing = template.Must(template.New("listing").Parse(`<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>{{.Path}}</title></head>
+<body>
+<h1>{{.Path}}</h1>
+<p>This session is shared read-only.</p>
+<ul>
+{{- if ne .Path "/"}}
+<li><a href="?path={{.Parent}}">../</a></li>
+{{- end}}
+{{- range .Entries}}
+<li><a href="?path={{.Path}}">{{.Name}}</a></li>
+{{- end}}
+</ul>
+</body>
+</html>
+`))
+
+type readOnlyEntry struct {
+	Name string
+	Path string
+}
+
+func (v readOnlyView) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet || r.URL.Path != "/" {
+		http.Error(w, "sshcode: this session is shared read-only", http.StatusForbidden)
+		return
+	}
+	// Nothing served here should run in the browser.
+	w.Header().Set("Content-Security-Policy", "default-src 'none'")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+
+	p := path.Clean("/" + r.URL.Query().Get("path"))
+	out, err := v.tr.command(fmt.Sprintf(readOnlyScript, v.dir, shellQuote("."+p), readOnlyMaxFileSize)).Output()
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	kind, content := out, []byte(nil)
+	if i := bytes.IndexByte(out, '\n'); i >= 0 {
+		kind, content = out[:i], out[i+1:]
+	}
+	switch string(kind) {
+	case "f":
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Write(content)
+	case "d":
+		var entries []readOnlyEntry
+		for _, name := range strings.Split(string(content), "\n") {
+			if name != "" {
+				entries = append(entries, readOnlyEntry{Name: name, Path: path.Join(p, name)})
+			}
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		err = readOnlyListing.Execute(w, map[string]interface{}{
+			"Path":    p,
+			"Parent":  path.Dir(p),
+			"Entries": entries,
+		})
+		if err != nil {
+			flog.Error("failed to list %v for a read-only guest: %v", p, err)
+		}
+	default:
+		http.NotFound(w, r)
+	}
+}
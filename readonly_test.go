@@ -0,0 +1,60 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestReadOnlyView(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sshcode-readonly")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	workspace := filepath.Join(dir, "workspace")
+	require.NoError(t, os.MkdirAll(filepath.Join(workspace, "src"), 0700))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(workspace, "src", "main.go"), []byte("package main\n"), 0600))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(workspace, "<b>.txt"), nil, 0600))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "secret"), []byte("hunter2"), 0600))
+	require.NoError(t, os.Symlink(filepath.Join(dir, "secret"), filepath.Join(workspace, "link")))
+
+	v := readOnlyView{tr: localTransport{home: dir}, dir: workspace}
+	do := func(method, p string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, "/?path="+url.QueryEscape(p), nil)
+		w := httptest.NewRecorder()
+		v.ServeHTTP(w, r)
+		return w
+	}
+
+	w := do("GET", "")
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Equal(t, "default-src 'none'", w.Header().Get("Content-Security-Policy"))
+	require.Contains(t, w.Body.String(), `<a href="?path=%2fsrc">src/</a>`)
+	require.Contains(t, w.Body.String(), "&lt;b&gt;.txt")
+	require.NotContains(t, w.Body.String(), "<b>")
+
+	w = do("GET", "/src/main.go")
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Equal(t, "text/plain; charset=utf-8", w.Header().Get("Content-Type"))
+	require.Equal(t, "package main\n", w.Body.String())
+
+	// Nothing outside the workspace is served.
+	for _, p := range []string{"../secret", "/../../secret", "link", "missing", "$(touch x)"} {
+		w = do("GET", p)
+		require.Equal(t, http.StatusNotFound, w.Code, p)
+		require.NotContains(t, w.Body.String(), "hunter2", p)
+	}
+	require.False(t, pathExists(filepath.Join(workspace, "x")))
+
+	require.Equal(t, http.StatusForbidden, do("POST", "").Code)
+	r := httptest.NewRequest("GET", "/static/app.js", nil)
+	w = httptest.NewRecorder()
+	v.ServeHTTP(w, r)
+	require.Equal(t, http.StatusForbidden, w.Code)
+}
@@ -0,0 +1,342 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"go.coder.com/flog"
+	"golang.org/x/xerrors"
+)
+
+// scrubbedValue replaces secret values in files uploaded to the remote host.
+const scrubbedValue = "<scrubbed by sshcode>"
+
+// defaultSecretKeys are matched against the last dot separated segment of
+// JSON keys, e.g. "github.copilot.advanced.authToken" matches "token".
+var defaultSecretKeys = []string{
+	"token",
+	"apikey",
+	"api_key",
+	"password",
+	"passwd",
+	"secret",
+	"credentials",
+	"privatekey",
+	"private_key",
+}
+
+// jsonStringPair matches a JSON (or JSON with comments) key with a string
+// value. Only string values are scrubbed.
+var jsonStringPair = regexp.MustCompile(`"((?:[^"\\]|\\.)*)"(\s*:\s*)"((?:[^"\\]|\\.)*)"`)
+
+// scrubber strips secret values from VS Code settings and extension storage
+// before they're uploaded.
+type scrubber struct {
+	keys []string
+	// uploadUnscanned uploads the files that can't be scrubbed rather than
+	// holding them back.
+	uploadUnscanned bool
+}
+
+// newScrubber returns a scrubber that recognizes the well known secret keys
+// and the extra keys configured by the user.
+func newScrubber(extraKeys []string) *scrubber {
+	keys := append([]string(nil), defaultSecretKeys...)
+	for _, k := range extraKeys {
+		keys = append(keys, strings.ToLower(k))
+	}
+	return &scrubber{keys: keys}
+}
+
+// isSecret reports whether the JSON key looks like it holds a secret. Keys
+// match either in full or by the suffix of their last segment.
+func (s *scrubber) isSecret(key string) bool {
+	key = strings.ToLower(key)
+	last := key[strings.LastIndex(key, ".")+1:]
+	for _, k := range s.keys {
+		if key == k || strings.HasSuffix(last, k) {
+			return true
+		}
+	}
+	return false
+}
+
+// scrub replaces secret values in b with scrubbedValue. It returns the
+// scrubbed content and the keys whose values were held back.
+func (s *scrubber) scrub(b []byte) ([]byte, []string) {
+	var keys []string
+	out := jsonStringPair.ReplaceAllFunc(b, func(m []byte) []byte {
+		sub := jsonStringPair.FindSubmatch(m)
+		key, sep, val := string(sub[1]), string(sub[2]), string(sub[3])
+		if val == "" || val == scrubbedValue || !s.isSecret(key) {
+			return m
+		}
+		keys = append(keys, key)
+		return []byte(`"` + key + `"` + sep + `"` + scrubbedValue + `"`)
+	})
+	return out, keys
+}
+
+// restore puts the secrets from original back into values of b that were
+// scrubbed before upload. Repeated keys are restored in order.
+func (s *scrubber) restore(b, original []byte) []byte {
+	secrets := make(map[string][]string)
+	for _, sub := range jsonStringPair.FindAllSubmatch(original, -1) {
+		key, val := string(sub[1]), string(sub[3])
+		if val != "" && val != scrubbedValue && s.isSecret(key) {
+			secrets[key] = append(secrets[key], val)
+		}
+	}
+
+	return jsonStringPair.ReplaceAllFunc(b, func(m []byte) []byte {
+		sub := jsonStringPair.FindSubmatch(m)
+		key, sep, val := string(sub[1]), string(sub[2]), string(sub[3])
+		if val != scrubbedValue || len(secrets[key]) == 0 {
+			return m
+		}
+		val, secrets[key] = secrets[key][0], secrets[key][1:]
+		return []byte(`"` + key + `"` + sep + `"` + val + `"`)
+	})
+}
+
+// isUnscanned reports whether the file rel, a slash separated path in the VS
+// Code user directory, is in extension global storage but isn't JSON, so it
+// may hold secrets that can't be scrubbed, like the state.vscdb database
+// extensions keep tokens in.
+func isUnscanned(rel string) bool {
+	if path.Ext(rel) == ".json" {
+		return false
+	}
+	for _, dir := range strings.Split(path.Dir(rel), "/") {
+		if dir == syncGlobalStorage {
+			return true
+		}
+	}
+	return false
+}
+
+// heldBack returns the files of unscanned that aren't synced in either
+// direction, as rsync exclude rules.
+func (s *scrubber) heldBack(unscanned []string) []string {
+	if s.uploadUnscanned {
+		return nil
+	}
+	rules := make([]string, len(unscanned))
+	for i, rel := range unscanned {
+		rules[i] = "- /" + rel
+	}
+	return rules
+}
+
+// warnUnscanned warns about the uploaded files that can't be scrubbed, or
+// that they were held back.
+func (s *scrubber) warnUnscanned(unscanned []string) {
+	for _, rel := range unscanned {
+		if s.uploadUnscanned {
+			flog.Info("warning: uploaded %v, which may hold secrets that can't be scrubbed", rel)
+		} else {
+			flog.Info("warning: held back %v, which may hold secrets that can't be scrubbed; pass --upload-unscanned to upload it", rel)
+		}
+	}
+}
+
+// findSecrets returns the JSON files in the VS Code user directory dir that
+// are synced in the given direction and contain secrets, keyed by their slash
+// separated path relative to dir, with the secret keys they contain. It also
+// returns the synced files that can't be scanned, as reported by isUnscanned.
+func (s *scrubber) findSecrets(dir string, spec syncSpec, back bool) (map[string][]string, []string, error) {
+	var (
+		found     = make(map[string][]string)
+		unscanned []string
+	)
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+
+		if info.IsDir() {
+			// Only descend into top-level directories something is synced from.
+			if path != dir && !strings.Contains(rel, "/") && !spec.coversDir(rel, back) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !spec.covers(rel, back) {
+			return nil
+		}
+		if isUnscanned(rel) {
+			unscanned = append(unscanned, rel)
+			return nil
+		}
+		if filepath.Ext(path) != ".json" {
+			return nil
+		}
+
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		_, keys := s.scrub(b)
+		if len(keys) > 0 {
+			found[rel] = keys
+		}
+		return nil
+	})
+	return found, unscanned, err
+}
+
+// stageScrubbed writes scrubbed copies of files, relative paths in the VS Code
+// user directory dir, to stageDir. Modification times are preserved so rsync
+// treats the copies like the originals.
+func (s *scrubber) stageScrubbed(dir, stageDir string, files []string) error {
+	for _, rel := range files {
+		src := filepath.Join(dir, filepath.FromSlash(rel))
+		info, err := os.Stat(src)
+		if err != nil {
+			return err
+		}
+		b, err := ioutil.ReadFile(src)
+		if err != nil {
+			return err
+		}
+		b, _ = s.scrub(b)
+
+		dest := filepath.Join(stageDir, filepath.FromSlash(rel))
+		err = os.MkdirAll(filepath.Dir(dest), 0700)
+		if err != nil {
+			return err
+		}
+		err = ioutil.WriteFile(dest, b, 0600)
+		if err != nil {
+			return err
+		}
+		err = os.Chtimes(dest, info.ModTime(), info.ModTime())
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// secretsBackupDir returns the local directory holding copies of the files in
+// the VS Code user directory dir that contain secrets while a sync-back
+// overwrites them.
+func secretsBackupDir(dir string) string {
+	return filepath.Join(stateDir(), "secrets-backup", url.PathEscape(dir))
+}
+
+// backupSecrets copies files, relative paths in the VS Code user directory
+// dir, to backupDir. A copy left by a sync-back that didn't finish is kept if
+// the file still holds scrubbed values, as it has the only copy of the
+// secrets.
+func backupSecrets(dir, backupDir string, files []string) error {
+	for _, rel := range files {
+		src := filepath.Join(dir, filepath.FromSlash(rel))
+		dest := filepath.Join(backupDir, filepath.FromSlash(rel))
+		if pathExists(dest) {
+			b, err := ioutil.ReadFile(src)
+			if err != nil {
+				return err
+			}
+			if bytes.Contains(b, []byte(scrubbedValue)) {
+				continue
+			}
+		}
+
+		info, err := os.Stat(src)
+		if err != nil {
+			return err
+		}
+		err = os.MkdirAll(filepath.Dir(dest), 0700)
+		if err != nil {
+			return err
+		}
+		err = copyFile(src, dest, info.Mode())
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// restoreSecrets puts the secrets in the copies in backupDir back into the
+// scrubbed files of the same name in the VS Code user directory dir, which
+// get the mode of the copies, and removes backupDir once all are restored.
+func (s *scrubber) restoreSecrets(dir, backupDir string) error {
+	if !pathExists(backupDir) {
+		return nil
+	}
+	err := filepath.Walk(backupDir, func(backup string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(backupDir, backup)
+		if err != nil {
+			return err
+		}
+		path := filepath.Join(dir, rel)
+
+		b, err := ioutil.ReadFile(path)
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if !bytes.Contains(b, []byte(scrubbedValue)) {
+			return nil
+		}
+		original, err := ioutil.ReadFile(backup)
+		if err != nil {
+			return err
+		}
+		err = ioutil.WriteFile(path, s.restore(b, original), info.Mode().Perm())
+		if err == nil {
+			// WriteFile only sets the mode of new files.
+			err = os.Chmod(path, info.Mode().Perm())
+		}
+		if err != nil {
+			return xerrors.Errorf("failed to restore secrets in %v, a copy is in %v: %w", filepath.ToSlash(rel), backup, err)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return os.RemoveAll(backupDir)
+}
+
+// includeFilters returns rsync filter rules that select exactly files, slash
+// separated relative paths, and the directories leading to them.
+func includeFilters(files []string) []string {
+	var (
+		rules []string
+		seen  = make(map[string]bool)
+	)
+	sorted := append([]string(nil), files...)
+	sort.Strings(sorted)
+	for _, rel := range sorted {
+		parts := strings.Split(rel, "/")
+		for i := 1; i < len(parts); i++ {
+			d := "/" + strings.Join(parts[:i], "/") + "/"
+			if !seen[d] {
+				seen[d] = true
+				rules = append(rules, "+ "+d)
+			}
+		}
+		rules = append(rules, "+ /"+rel)
+	}
+	return append(rules, "- *")
+}
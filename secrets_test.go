@@ -0,0 +1,120 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestScrubber(t *testing.T) {
+	const settings = `{
+	// Keep the editor quiet.
+	"editor.semanticTokenColorCustomizations": {"enabled": true},
+	"github.copilot.advanced": {"authToken": "ghu_abc"},
+	"rest-client.environmentVariables": {
+		"dev": {"token": "one"},
+		"prod": {"token": "two", "host": "example.com"}
+	},
+	"myext.endpoint": "https://example.com",
+	"myext.clientId": ""
+}`
+
+	s := newScrubber([]string{"myext.endpoint"})
+	scrubbed, keys := s.scrub([]byte(settings))
+	require.Equal(t, []string{"authToken", "token", "token", "myext.endpoint"}, keys)
+	require.NotContains(t, string(scrubbed), "ghu_abc")
+	require.NotContains(t, string(scrubbed), "two")
+	require.Contains(t, string(scrubbed), `"host": "example.com"`)
+
+	require.Equal(t, settings, string(s.restore(scrubbed, []byte(settings))))
+}
+
+func TestIncludeFilters(t *testing.T) {
+	require.Equal(t, []string{
+		"+ /globalStorage/",
+		"+ /globalStorage/humao.rest-client/",
+		"+ /globalStorage/humao.rest-client/env.json",
+		"+ /settings.json",
+		"- *",
+	}, includeFilters([]string{"settings.json", "globalStorage/humao.rest-client/env.json"}))
+}
+
+func TestBackupSecrets(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sshcode-secrets")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	userDir := filepath.Join(dir, "User")
+	backupDir := filepath.Join(dir, "backup")
+	settings := filepath.Join(userDir, "settings.json")
+	const original = `{"github.copilot.advanced": {"authToken": "ghu_abc"}}`
+	require.NoError(t, os.MkdirAll(userDir, 0700))
+	require.NoError(t, ioutil.WriteFile(settings, []byte(original), 0640))
+
+	s := newScrubber(nil)
+	scrubbed, _ := s.scrub([]byte(original))
+	require.NoError(t, backupSecrets(userDir, backupDir, []string{"settings.json"}))
+
+	// The sync-back overwrites the file with the scrubbed copy, then
+	// sshcode stops before restoring it.
+	require.NoError(t, os.Remove(settings))
+	require.NoError(t, ioutil.WriteFile(settings, scrubbed, 0600))
+
+	// The next sync-back finds no secrets in the file, but keeps the backup.
+	require.NoError(t, backupSecrets(userDir, backupDir, nil))
+	require.NoError(t, s.restoreSecrets(userDir, backupDir))
+
+	b, err := ioutil.ReadFile(settings)
+	require.NoError(t, err)
+	require.Equal(t, original, string(b))
+	info, err := os.Stat(settings)
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0640), info.Mode().Perm())
+	require.False(t, pathExists(backupDir))
+}
+
+func TestFindSecrets(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sshcode-secrets")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	files := map[string]string{
+		"settings.json":                       `{"github.copilot.advanced": {"authToken": "ghu_abc"}}`,
+		"snippets/go.code-snippets":           `{}`,
+		"globalStorage/state.vscdb":           "state",
+		"globalStorage/ext.id/auth.json":      `{"token": "abc"}`,
+		"globalStorage/ext.id/cache.bin":      "cache",
+		"profiles/abc/globalStorage/state.db": "state",
+		"workspaceStorage/abc/state.vscdb":    "state",
+		"globalStorage/ext.id/settings.json":  `{}`,
+	}
+	for rel, content := range files {
+		path := filepath.Join(dir, filepath.FromSlash(rel))
+		require.NoError(t, os.MkdirAll(filepath.Dir(path), 0700))
+		require.NoError(t, ioutil.WriteFile(path, []byte(content), 0600))
+	}
+
+	s := newScrubber(nil)
+	secrets, unscanned, err := s.findSecrets(dir, defaultSyncSpec(), false)
+	require.NoError(t, err)
+	require.Equal(t, map[string][]string{
+		"settings.json":                  {"authToken"},
+		"globalStorage/ext.id/auth.json": {"token"},
+	}, secrets)
+	require.Equal(t, []string{
+		"globalStorage/ext.id/cache.bin",
+		"globalStorage/state.vscdb",
+		"profiles/abc/globalStorage/state.db",
+	}, unscanned)
+	require.Equal(t, []string{
+		"- /globalStorage/ext.id/cache.bin",
+		"- /globalStorage/state.vscdb",
+		"- /profiles/abc/globalStorage/state.db",
+	}, s.heldBack(unscanned))
+
+	s.uploadUnscanned = true
+	require.Empty(t, s.heldBack(unscanned))
+}
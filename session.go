@@ -0,0 +1,173 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"syscall"
+	"time"
+
+	"golang.org/x/xerrors"
+)
+
+const (
+	// sessionFile holds a session's metadata in its local directory.
+	sessionFile = "session.json"
+	// sessionLog is the local copy of a session's code-server output.
+	sessionLog = "code-server.log"
+	// keptSessions is how many ended sessions are kept for their logs.
+	keptSessions = 20
+)
+
+// remoteLogDir is where code-server writes its output on the remote host.
+const remoteLogDir = "~/.cache/sshcode/logs"
+
+// remoteLogMaxDays is how many days remote logs are kept for. Older ones are
+// removed when a session starts.
+const remoteLogMaxDays = 7
+
+// remoteLogPath returns the remote log file of the session with the given ID.
+func remoteLogPath(sessionID string) string {
+	return remoteLogDir + "/" + sessionID + ".log"
+}
+
+// sessionInfo describes a session started by sshcode.
+type sessionInfo struct {
+	ID      string     `json:"id"`
+	Host    string     `json:"host"`
+	Dir     string     `json:"dir"`
+	PID     int        `json:"pid"`
+	URL     string     `json:"url,omitempty"`
+	Started time.Time  `json:"started"`
+	Ended   *time.Time `json:"ended,omitempty"`
+	// SSHHost and SSHFlags are how the host was reached over ssh, if it
+	// was, to read the remote log.
+	SSHHost  string `json:"ssh_host,omitempty"`
+	SSHFlags string `json:"ssh_flags,omitempty"`
+}
+
+func sessionsDir() string {
+	return filepath.Join(stateDir(), "sessions")
+}
+
+// sessionLogPath returns the local log file of the session with the given ID.
+func sessionLogPath(sessionID string) string {
+	return filepath.Join(sessionsDir(), sessionID, sessionLog)
+}
+
+// writeSession records s in its local session directory.
+func writeSession(s sessionInfo) error {
+	b, err := json.MarshalIndent(s, "", "\t")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(filepath.Join(sessionsDir(), s.ID, sessionFile), b)
+}
+
+func readSession(sessionID string) (sessionInfo, error) {
+	var s sessionInfo
+	b, err := ioutil.ReadFile(filepath.Join(sessionsDir(), sessionID, sessionFile))
+	if err != nil {
+		return s, err
+	}
+	err = json.Unmarshal(b, &s)
+	return s, err
+}
+
+// listSessions returns the recorded sessions, oldest first.
+func listSessions() ([]sessionInfo, error) {
+	infos, err := ioutil.ReadDir(sessionsDir())
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var sessions []sessionInfo
+	for _, info := range infos {
+		s, err := readSession(info.Name())
+		if err != nil {
+			// Sessions that are starting or were written by an older
+			// version have no metadata.
+			continue
+		}
+		sessions = append(sessions, s)
+	}
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].Started.Before(sessions[j].Started)
+	})
+	return sessions, nil
+}
+
+// findSession returns the session with the given ID, or the latest session
+// if id is empty.
+func findSession(id string) (sessionInfo, error) {
+	if id != "" {
+		s, err := readSession(id)
+		if os.IsNotExist(err) {
+			return s, xerrors.Errorf("no session %v", id)
+		}
+		return s, err
+	}
+
+	sessions, err := listSessions()
+	if err != nil {
+		return sessionInfo{}, err
+	}
+	if len(sessions) == 0 {
+		return sessionInfo{}, xerrors.New("no sessions found")
+	}
+	return sessions[len(sessions)-1], nil
+}
+
+// running reports whether the session is still running.
+func (s sessionInfo) running() bool {
+	return s.Ended == nil && processAlive(s.PID)
+}
+
+// endedUncleanly reports whether the session's sshcode stopped without
+// recording the end of the session, in which case code-server may have kept
+// running and writing its remote log after the local one ends.
+func (s sessionInfo) endedUncleanly() bool {
+	return s.Ended == nil && !processAlive(s.PID)
+}
+
+func processAlive(pid int) bool {
+	p, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+	if runtime.GOOS == "windows" {
+		// FindProcess fails on Windows if the process doesn't exist.
+		return true
+	}
+	return p.Signal(syscall.Signal(0)) == nil
+}
+
+// pruneSessions removes all but the latest keptSessions sessions that are
+// no longer running.
+func pruneSessions() error {
+	sessions, err := listSessions()
+	if err != nil {
+		return err
+	}
+
+	var ended []sessionInfo
+	for _, s := range sessions {
+		if !s.running() {
+			ended = append(ended, s)
+		}
+	}
+	for len(ended) > keptSessions {
+		err = os.RemoveAll(filepath.Join(sessionsDir(), ended[0].ID))
+		if err != nil {
+			return err
+		}
+		ended = ended[1:]
+	}
+	return nil
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSessions(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sshcode-state")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	old, ok := os.LookupEnv("XDG_STATE_HOME")
+	if ok {
+		defer os.Setenv("XDG_STATE_HOME", old)
+	} else {
+		defer os.Unsetenv("XDG_STATE_HOME")
+	}
+	os.Setenv("XDG_STATE_HOME", dir)
+
+	_, err = findSession("")
+	require.Error(t, err)
+
+	start := time.Now().Add(-time.Hour)
+	for i := 0; i < keptSessions+2; i++ {
+		ended := start.Add(time.Duration(i) * time.Second)
+		s := sessionInfo{
+			ID:      fmt.Sprintf("ended%02d", i),
+			Host:    "dev",
+			PID:     os.Getpid(),
+			Started: ended,
+			Ended:   &ended,
+		}
+		_, err = localSessionDir(s.ID)
+		require.NoError(t, err)
+		require.NoError(t, writeSession(s))
+	}
+	running := sessionInfo{
+		ID:      "running",
+		Host:    "dev",
+		PID:     os.Getpid(),
+		Started: start,
+	}
+	_, err = localSessionDir(running.ID)
+	require.NoError(t, err)
+	require.NoError(t, writeSession(running))
+	require.True(t, running.running())
+	require.False(t, running.endedUncleanly())
+
+	latest, err := findSession("")
+	require.NoError(t, err)
+	require.Equal(t, fmt.Sprintf("ended%02d", keptSessions+1), latest.ID)
+	require.False(t, latest.running())
+	require.False(t, latest.endedUncleanly())
+
+	// A dead sshcode that didn't record the end of its session.
+	crashed := sessionInfo{ID: "crashed", PID: 1 << 22}
+	require.True(t, crashed.endedUncleanly())
+
+	s, err := findSession("running")
+	require.NoError(t, err)
+	require.Equal(t, running.ID, s.ID)
+
+	require.NoError(t, pruneSessions())
+	sessions, err := listSessions()
+	require.NoError(t, err)
+	require.Len(t, sessions, keptSessions+1)
+	_, err = os.Stat(filepath.Join(sessionsDir(), "ended00"))
+	require.True(t, os.IsNotExist(err))
+	_, err = os.Stat(filepath.Join(sessionsDir(), "running"))
+	require.NoError(t, err)
+}
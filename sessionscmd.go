@@ -0,0 +1,146 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"runtime"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/pflag"
+	"go.coder.com/cli"
+	"go.coder.com/flog"
+	"golang.org/x/xerrors"
+)
+
+// stopTimeout is how long stop waits for a session to shut down, which
+// includes syncing back.
+const stopTimeout = time.Minute
+
+var _ interface {
+	cli.Command
+	cli.FlaggedCommand
+} = new(sessionsCmd)
+
+type sessionsCmd struct {
+	all       bool
+	printJSON bool
+}
+
+func (c *sessionsCmd) Spec() cli.CommandSpec {
+	return cli.CommandSpec{
+		Name:  "sessions",
+		Usage: "[FLAGS]",
+		Desc:  "List running sessions.",
+	}
+}
+
+func (c *sessionsCmd) RegisterFlags(fl *pflag.FlagSet) {
+	fl.BoolVarP(&c.all, "all", "a", false, "also list sessions that ended")
+	fl.BoolVar(&c.printJSON, "json", false, "print sessions as JSON")
+}
+
+func (c *sessionsCmd) Run(fl *pflag.FlagSet) {
+	sessions, err := listSessions()
+	if err != nil {
+		flog.Fatal("failed to list sessions: %v", err)
+	}
+	err = printSessions(os.Stdout, sessions, c.all, c.printJSON)
+	if err != nil {
+		flog.Fatal("failed to print sessions: %v", err)
+	}
+}
+
+// printSessions prints the running sessions, or all of them if all is set, as
+// a table or JSON.
+func printSessions(out io.Writer, sessions []sessionInfo, all, printJSON bool) error {
+	listed := []sessionInfo{}
+	for _, s := range sessions {
+		if all || s.running() {
+			listed = append(listed, s)
+		}
+	}
+
+	if printJSON {
+		return json.NewEncoder(out).Encode(listed)
+	}
+
+	w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "SESSION\tHOST\tDIR\tSTARTED\tSTATUS\tURL")
+	for _, s := range listed {
+		status := "running"
+		if !s.running() {
+			status = "ended"
+		}
+		fmt.Fprintf(w, "%v\t%v\t%v\t%v\t%v\t%v\n",
+			s.ID, s.Host, s.Dir, s.Started.Format("2006-01-02 15:04"), status, s.URL,
+		)
+	}
+	return w.Flush()
+}
+
+var _ cli.Command = new(stopCmd)
+
+type stopCmd struct{}
+
+func (c *stopCmd) Spec() cli.CommandSpec {
+	return cli.CommandSpec{
+		Name:  "stop",
+		Usage: "SESSION",
+		Desc:  "Stop a session, syncing back if it was started with -b.",
+	}
+}
+
+func (c *stopCmd) Run(fl *pflag.FlagSet) {
+	id := fl.Arg(0)
+	if id == "" {
+		fl.Usage()
+		os.Exit(1)
+	}
+
+	s, err := findSession(id)
+	if err != nil {
+		flog.Fatal("%v", err)
+	}
+	if !s.running() {
+		flog.Info("session %v isn't running", s.ID)
+		return
+	}
+
+	err = stopSession(s, stopTimeout)
+	if err != nil {
+		flog.Fatal("%v", err)
+	}
+	flog.Info("stopped session %v", s.ID)
+}
+
+// stopSession asks the running session s to shut down and waits up to
+// timeout for it to.
+func stopSession(s sessionInfo, timeout time.Duration) error {
+	p, err := os.FindProcess(s.PID)
+	if err != nil {
+		return xerrors.Errorf("failed to find session process: %w", err)
+	}
+	if runtime.GOOS == "windows" {
+		// Windows can't deliver SIGTERM.
+		err = p.Kill()
+	} else {
+		err = p.Signal(syscall.SIGTERM)
+	}
+	if err != nil {
+		return xerrors.Errorf("failed to stop session: %w", err)
+	}
+
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		s, err = readSession(s.ID)
+		if err != nil || !s.running() {
+			return nil
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	return xerrors.Errorf("session %v didn't stop within %v, see `sshcode logs %v`", s.ID, timeout, s.ID)
+}
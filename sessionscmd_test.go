@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestPrintSessions(t *testing.T) {
+	started := time.Date(2019, 5, 1, 12, 30, 0, 0, time.UTC)
+	ended := started.Add(time.Hour)
+	sessions := []sessionInfo{
+		{ID: "old", Host: "dev", Dir: "~/old", PID: os.Getpid(), Started: started, Ended: &ended},
+		{ID: "cur", Host: "dev", Dir: "~/cur", PID: os.Getpid(), URL: "http://127.0.0.1:8080", Started: started},
+	}
+
+	var out bytes.Buffer
+	require.NoError(t, printSessions(&out, sessions, false, false))
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	require.Len(t, lines, 2)
+	require.Equal(t, []string{"SESSION", "HOST", "DIR", "STARTED", "STATUS", "URL"}, strings.Fields(lines[0]))
+	require.Equal(t, []string{"cur", "dev", "~/cur", "2019-05-01", "12:30", "running", "http://127.0.0.1:8080"}, strings.Fields(lines[1]))
+
+	out.Reset()
+	require.NoError(t, printSessions(&out, sessions, true, false))
+	require.Contains(t, out.String(), "ended")
+
+	out.Reset()
+	require.NoError(t, printSessions(&out, sessions, false, true))
+	var listed []sessionInfo
+	require.NoError(t, json.Unmarshal(out.Bytes(), &listed))
+	require.Len(t, listed, 1)
+	require.Equal(t, "cur", listed[0].ID)
+
+	// No sessions are listed as an empty array rather than null.
+	out.Reset()
+	require.NoError(t, printSessions(&out, nil, false, true))
+	require.Equal(t, "[]\n", out.String())
+}
+
+func TestStopSession(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sshcode-state")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	old, ok := os.LookupEnv("XDG_STATE_HOME")
+	if ok {
+		defer os.Setenv("XDG_STATE_HOME", old)
+	} else {
+		defer os.Unsetenv("XDG_STATE_HOME")
+	}
+	os.Setenv("XDG_STATE_HOME", dir)
+
+	// start runs script as a session and reaps it once it exits, as an
+	// unreaped process still looks alive.
+	start := func(id, script string) sessionInfo {
+		cmd := exec.Command("sh", "-c", script)
+		require.NoError(t, cmd.Start())
+		go cmd.Wait()
+
+		s := sessionInfo{ID: id, PID: cmd.Process.Pid, Started: time.Now()}
+		_, err := localSessionDir(s.ID)
+		require.NoError(t, err)
+		require.NoError(t, writeSession(s))
+		return s
+	}
+
+	t.Run("Stops", func(t *testing.T) {
+		s := start("stops", "exec sleep 60")
+		require.NoError(t, stopSession(s, 5*time.Second))
+		require.False(t, s.running())
+	})
+
+	t.Run("Timeout", func(t *testing.T) {
+		s := start("ignores", `trap "" TERM; sleep 5`)
+		// Let the shell set up its trap.
+		time.Sleep(200 * time.Millisecond)
+		defer func() {
+			p, err := os.FindProcess(s.PID)
+			if err == nil {
+				p.Kill()
+			}
+		}()
+
+		err := stopSession(s, 500*time.Millisecond)
+		require.Error(t, err)
+		require.Contains(t, err.Error(), "sshcode logs ignores")
+		require.True(t, s.running())
+	})
+}
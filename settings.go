@@ -4,6 +4,7 @@ import (
 	"os"
 	"path/filepath"
 	"runtime"
+	"strings"
 
 	"golang.org/x/xerrors"
 )
@@ -13,38 +14,165 @@ const (
 	vsCodeExtensionsDirEnv = "VSCODE_EXTENSIONS_DIR"
 )
 
-func configDir() (string, error) {
-	if env, ok := os.LookupEnv(vsCodeConfigDirEnv); ok {
-		return os.ExpandEnv(env), nil
+// vsCodeFlavor describes where a release of VS Code keeps its user data.
+type vsCodeFlavor struct {
+	name string
+	// appName is the name of the directory VS Code keeps its user directory in.
+	appName string
+	// extensionsDir is the extensions directory relative to $HOME.
+	extensionsDir string
+	// flatpakID and flatpakDataDir locate Flatpak installs, if any.
+	flatpakID      string
+	flatpakDataDir string
+	// snapName locates Snap installs, if any.
+	snapName string
+}
+
+// vsCodeFlavors are the supported releases of VS Code, in the order they're
+// probed in.
+var vsCodeFlavors = []vsCodeFlavor{
+	{
+		name:           "code",
+		appName:        "Code",
+		extensionsDir:  ".vscode/extensions",
+		flatpakID:      "com.visualstudio.code",
+		flatpakDataDir: "vscode",
+		snapName:       "code",
+	},
+	{
+		name:          "insiders",
+		appName:       "Code - Insiders",
+		extensionsDir: ".vscode-insiders/extensions",
+		snapName:      "code-insiders",
+	},
+	{
+		name:           "vscodium",
+		appName:        "VSCodium",
+		extensionsDir:  ".vscode-oss/extensions",
+		flatpakID:      "com.vscodium.codium",
+		flatpakDataDir: "codium",
+		snapName:       "codium",
+	},
+	{
+		name:           "oss",
+		appName:        "Code - OSS",
+		extensionsDir:  ".vscode-oss/extensions",
+		flatpakID:      "com.visualstudio.code-oss",
+		flatpakDataDir: "vscode-oss",
+	},
+}
+
+// vsCodeInstall is the pair of local directories sshcode syncs from.
+type vsCodeInstall struct {
+	flavor        string
+	configDir     string
+	extensionsDir string
+}
+
+// installs returns the places f may be installed on this platform. The first
+// one is the default location.
+func (f vsCodeFlavor) installs() ([]vsCodeInstall, error) {
+	home := os.Getenv("HOME")
+	install := func(configDir, extensionsDir string) vsCodeInstall {
+		return vsCodeInstall{
+			flavor:        f.name,
+			configDir:     filepath.Clean(configDir),
+			extensionsDir: filepath.Clean(extensionsDir),
+		}
 	}
 
-	var path string
 	switch runtime.GOOS {
 	case "linux":
-		path = os.ExpandEnv("$HOME/.config/Code/User/")
+		configHome := os.Getenv("XDG_CONFIG_HOME")
+		if configHome == "" {
+			configHome = filepath.Join(home, ".config")
+		}
+
+		installs := []vsCodeInstall{
+			install(filepath.Join(configHome, f.appName, "User"), filepath.Join(home, f.extensionsDir)),
+		}
+		if f.flatpakID != "" {
+			appDir := filepath.Join(home, ".var/app", f.flatpakID)
+			installs = append(installs, install(
+				filepath.Join(appDir, "config", f.appName, "User"),
+				filepath.Join(appDir, "data", f.flatpakDataDir, "extensions"),
+			))
+		}
+		if f.snapName != "" {
+			snapHome := filepath.Join(home, "snap", f.snapName, "current")
+			installs = append(installs, install(
+				filepath.Join(snapHome, ".config", f.appName, "User"),
+				filepath.Join(snapHome, f.extensionsDir),
+			))
+		}
+		return installs, nil
 	case "darwin":
-		path = os.ExpandEnv("$HOME/Library/Application Support/Code/User/")
+		return []vsCodeInstall{
+			install(filepath.Join(home, "Library/Application Support", f.appName, "User"), filepath.Join(home, f.extensionsDir)),
+		}, nil
 	case "windows":
-		return os.ExpandEnv("/c/Users/$USERNAME/AppData/Roaming/Code/User"), nil
+		// filepath.Clean would turn the git bash style paths into relative ones.
+		return []vsCodeInstall{{
+			flavor:        f.name,
+			configDir:     os.ExpandEnv("/c/Users/$USERNAME/AppData/Roaming/" + f.appName + "/User"),
+			extensionsDir: os.ExpandEnv("/c/Users/$USERNAME/" + f.extensionsDir),
+		}}, nil
 	default:
-		return "", xerrors.Errorf("unsupported platform: %s", runtime.GOOS)
+		return nil, xerrors.Errorf("unsupported platform: %s", runtime.GOOS)
+	}
+}
+
+// flavorNames returns the names of the supported VS Code flavors.
+func flavorNames() []string {
+	names := make([]string, len(vsCodeFlavors))
+	for i, f := range vsCodeFlavors {
+		names[i] = f.name
 	}
-	return filepath.Clean(path), nil
+	return names
 }
 
-func extensionsDir() (string, error) {
+// findInstall returns the local VS Code directories to sync. If flavor is
+// empty, the installed flavors are probed and the first one found is used.
+// The VSCODE_CONFIG_DIR and VSCODE_EXTENSIONS_DIR environment variables take
+// precedence over whatever is found.
+func findInstall(flavor string) (vsCodeInstall, error) {
+	install, err := probeInstall(flavor)
+	if err != nil {
+		return install, err
+	}
+
+	if env, ok := os.LookupEnv(vsCodeConfigDirEnv); ok {
+		install.configDir = os.ExpandEnv(env)
+	}
 	if env, ok := os.LookupEnv(vsCodeExtensionsDirEnv); ok {
-		return os.ExpandEnv(env), nil
+		install.extensionsDir = os.ExpandEnv(env)
 	}
+	return install, nil
+}
 
-	var path string
-	switch runtime.GOOS {
-	case "linux", "darwin":
-		path = os.ExpandEnv("$HOME/.vscode/extensions/")
-	case "windows":
-		return os.ExpandEnv("/c/Users/$USERNAME/.vscode/extensions"), nil
-	default:
-		return "", xerrors.Errorf("unsupported platform: %s", runtime.GOOS)
+func probeInstall(flavor string) (vsCodeInstall, error) {
+	var candidates []vsCodeInstall
+	for _, f := range vsCodeFlavors {
+		if flavor != "" && f.name != flavor {
+			continue
+		}
+		installs, err := f.installs()
+		if err != nil {
+			return vsCodeInstall{}, err
+		}
+		candidates = append(candidates, installs...)
+	}
+	if len(candidates) == 0 {
+		return vsCodeInstall{}, xerrors.Errorf("unknown VS Code flavor %q, expected one of %v",
+			flavor, strings.Join(flavorNames(), ", "),
+		)
+	}
+
+	for _, install := range candidates {
+		if pathExists(install.configDir) {
+			return install, nil
+		}
 	}
-	return filepath.Clean(path), nil
+	// Nothing is installed yet, fall back to the default location.
+	return candidates[0], nil
 }
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestFindInstall(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("install locations are only probed on linux")
+	}
+
+	home, err := ioutil.TempDir("", "sshcode-home")
+	require.NoError(t, err)
+	defer os.RemoveAll(home)
+
+	for _, env := range []string{"HOME", "XDG_CONFIG_HOME", vsCodeConfigDirEnv, vsCodeExtensionsDirEnv} {
+		old, ok := os.LookupEnv(env)
+		if ok {
+			defer os.Setenv(env, old)
+		} else {
+			defer os.Unsetenv(env)
+		}
+		os.Unsetenv(env)
+	}
+	os.Setenv("HOME", home)
+
+	// Nothing installed falls back to stock VS Code.
+	install, err := findInstall("")
+	require.NoError(t, err)
+	require.Equal(t, "code", install.flavor)
+	require.Equal(t, filepath.Join(home, ".config/Code/User"), install.configDir)
+
+	// A Flatpak VSCodium install is detected.
+	flatpak := filepath.Join(home, ".var/app/com.vscodium.codium")
+	require.NoError(t, os.MkdirAll(filepath.Join(flatpak, "config/VSCodium/User"), 0750))
+	install, err = findInstall("")
+	require.NoError(t, err)
+	require.Equal(t, vsCodeInstall{
+		flavor:        "vscodium",
+		configDir:     filepath.Join(flatpak, "config/VSCodium/User"),
+		extensionsDir: filepath.Join(flatpak, "data/codium/extensions"),
+	}, install)
+
+	// XDG_CONFIG_HOME is honored and an explicit flavor skips probing.
+	os.Setenv("XDG_CONFIG_HOME", filepath.Join(home, "xdg"))
+	install, err = findInstall("insiders")
+	require.NoError(t, err)
+	require.Equal(t, filepath.Join(home, "xdg/Code - Insiders/User"), install.configDir)
+	require.Equal(t, filepath.Join(home, ".vscode-insiders/extensions"), install.extensionsDir)
+
+	_, err = findInstall("notepad")
+	require.Error(t, err)
+}
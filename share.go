@@ -0,0 +1,167 @@
+package main
+
+import (
+	"crypto/subtle"
+	"net"
+	"net/http"
+	"sync"
+)
+
+const (
+	// shareTokenParam is the query parameter share links carry their token in.
+	shareTokenParam = "sshcode_token"
+	// shareCookie holds the session of a browser that redeemed a token.
+	shareCookie = "sshcode_session"
+)
+
+// shareAuth only lets browsers that redeemed a token through to code-server.
+// The owner's token can be redeemed any number of times, the guest's once.
+type shareAuth struct {
+	next       http.Handler
+	ownerToken string
+	// readOnly serves the guest instead of next if set.
+	readOnly http.Handler
+
+	mu         sync.Mutex
+	guestToken string
+	// sessions maps the session cookies of browsers that redeemed a token to
+	// whether they're read-only.
+	sessions map[string]bool
+}
+
+// newShareAuth returns a shareAuth in front of next along with the owner's
+// and the guest's tokens. The guest is served by readOnly instead if it isn't
+// nil.
+func newShareAuth(next, readOnly http.Handler) (*shareAuth, error) {
+	owner, err := randomHex(16)
+	if err != nil {
+		return nil, err
+	}
+	guest, err := randomHex(16)
+	if err != nil {
+		return nil, err
+	}
+
+	return &shareAuth{
+		next:       next,
+		ownerToken: owner,
+		readOnly:   readOnly,
+		guestToken: guest,
+		sessions:   make(map[string]bool),
+	}, nil
+}
+
+// redeem exchanges token for a new session, which is read-only if readOnly
+// is set. It returns an empty session if the token is invalid.
+func (a *shareAuth) redeem(token string) (session string, readOnly bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	switch {
+	case token == "":
+		return "", false
+	case tokenEqual(token, a.ownerToken):
+	case a.guestToken != "" && tokenEqual(token, a.guestToken):
+		a.guestToken = ""
+		readOnly = a.readOnly != nil
+	default:
+		return "", false
+	}
+
+	session, err := randomHex(16)
+	if err != nil {
+		return "", false
+	}
+	a.sessions[session] = readOnly
+	return session, readOnly
+}
+
+// tokenEqual compares tokens in constant time, so they can't be guessed from
+// how long a comparison takes.
+func tokenEqual(a, b string) bool {
+	return subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
+}
+
+// session reports whether r carries a valid session cookie, and whether the
+// session is read-only.
+func (a *shareAuth) session(r *http.Request) (ok, readOnly bool) {
+	c, err := r.Cookie(shareCookie)
+	if err != nil {
+		return false, false
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	readOnly, ok = a.sessions[c.Value]
+	return ok, readOnly
+}
+
+func (a *shareAuth) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ok, readOnly := a.session(r)
+
+	q := r.URL.Query()
+	if token := q.Get(shareTokenParam); token != "" {
+		var session string
+		session, readOnly = a.redeem(token)
+		if session == "" {
+			http.Error(w, "sshcode: this share link was already used or is invalid", http.StatusUnauthorized)
+			return
+		}
+		ok = true
+
+		http.SetCookie(w, &http.Cookie{
+			Name:     shareCookie,
+			Value:    session,
+			Path:     "/",
+			HttpOnly: true,
+			// Shares are only served over TLS.
+			Secure: true,
+		})
+
+		q.Del(shareTokenParam)
+		r.URL.RawQuery = q.Encode()
+		if r.Method == http.MethodGet {
+			// Keep the token out of the address bar and history.
+			http.Redirect(w, r, r.URL.RequestURI(), http.StatusSeeOther)
+			return
+		}
+	}
+
+	if !ok {
+		http.Error(w, "sshcode: open the share link to access this session", http.StatusUnauthorized)
+		return
+	}
+	if readOnly {
+		a.readOnly.ServeHTTP(w, r)
+		return
+	}
+
+	a.next.ServeHTTP(w, r)
+}
+
+// shareHost returns the address other machines on the network can most
+// likely reach this one at.
+func shareHost() string {
+	// No packets are sent, this only picks the interface of the default route.
+	conn, err := net.Dial("udp", "192.0.2.1:9")
+	if err == nil {
+		defer conn.Close()
+		if addr, ok := conn.LocalAddr().(*net.UDPAddr); ok {
+			return addr.IP.String()
+		}
+	}
+	return "localhost"
+}
+
+// shareURL returns the URL for token on the share served over scheme at
+// bindAddr.
+func shareURL(scheme, bindAddr, token string) string {
+	host, port, err := net.SplitHostPort(bindAddr)
+	if err != nil {
+		return ""
+	}
+	if ip := net.ParseIP(host); host == "" || ip != nil && ip.IsUnspecified() {
+		host = shareHost()
+	}
+	return scheme + "://" + net.JoinHostPort(host, port) + "/?" + shareTokenParam + "=" + token
+}
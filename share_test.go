@@ -0,0 +1,96 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestShareAuth(t *testing.T) {
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Empty(t, r.URL.Query().Get(shareTokenParam))
+	})
+	auth, err := newShareAuth(ok, nil)
+	require.NoError(t, err)
+
+	do := func(method, target string, cookie *http.Cookie, header http.Header) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, target, nil)
+		if cookie != nil {
+			r.AddCookie(cookie)
+		}
+		for k, v := range header {
+			r.Header[k] = v
+		}
+		w := httptest.NewRecorder()
+		auth.ServeHTTP(w, r)
+		return w
+	}
+	sessionCookie := func(w *httptest.ResponseRecorder) *http.Cookie {
+		for _, c := range w.Result().Cookies() {
+			if c.Name == shareCookie {
+				return c
+			}
+		}
+		t.Fatal("no session cookie set")
+		return nil
+	}
+
+	require.Equal(t, http.StatusUnauthorized, do("GET", "/", nil, nil).Code)
+
+	// The guest token works once and redirects to drop the token.
+	w := do("GET", "/?"+shareTokenParam+"="+auth.guestToken, nil, nil)
+	require.Equal(t, http.StatusSeeOther, w.Code)
+	require.Equal(t, "/", w.Header().Get("Location"))
+	guest := sessionCookie(w)
+	require.Equal(t, http.StatusUnauthorized, do("GET", "/?"+shareTokenParam+"="+auth.ownerToken+"x", nil, nil).Code)
+
+	require.Equal(t, http.StatusOK, do("GET", "/static/app.js", guest, nil).Code)
+	require.Equal(t, http.StatusOK, do("POST", "/upload", guest, nil).Code)
+	require.Equal(t, http.StatusOK, do("GET", "/", guest, http.Header{"Upgrade": {"websocket"}}).Code)
+	require.Equal(t, http.StatusUnauthorized, do("GET", "/", &http.Cookie{Name: shareCookie, Value: "x"}, nil).Code)
+
+	// The owner's token can be reused, e.g. by the login page.
+	w = do("POST", "/login?"+shareTokenParam+"="+auth.ownerToken, nil, nil)
+	require.Equal(t, http.StatusOK, w.Code)
+	owner := sessionCookie(w)
+	require.Equal(t, http.StatusOK, do("POST", "/upload", owner, nil).Code)
+	require.Equal(t, http.StatusSeeOther, do("GET", "/?"+shareTokenParam+"="+auth.ownerToken, nil, nil).Code)
+}
+
+func TestShareAuthReadOnly(t *testing.T) {
+	editor := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("editor"))
+	})
+	view := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("view"))
+	})
+	auth, err := newShareAuth(editor, view)
+	require.NoError(t, err)
+
+	redeem := func(token string) *http.Cookie {
+		r := httptest.NewRequest("GET", "/?"+shareTokenParam+"="+token, nil)
+		w := httptest.NewRecorder()
+		auth.ServeHTTP(w, r)
+		require.Equal(t, http.StatusSeeOther, w.Code)
+		c := w.Result().Cookies()[0]
+		require.True(t, c.Secure)
+		return c
+	}
+	get := func(cookie *http.Cookie, target string) string {
+		r := httptest.NewRequest("GET", target, nil)
+		r.AddCookie(cookie)
+		w := httptest.NewRecorder()
+		auth.ServeHTTP(w, r)
+		return w.Body.String()
+	}
+
+	// The guest never reaches the editor, whatever the path.
+	guest := redeem(auth.guestToken)
+	require.Equal(t, "view", get(guest, "/"))
+	require.Equal(t, "view", get(guest, "/static/app.js"))
+
+	owner := redeem(auth.ownerToken)
+	require.Equal(t, "editor", get(owner, "/"))
+}
@@ -2,7 +2,12 @@ package main
 
 import (
 	"context"
+	crand "crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"math/rand"
 	"net"
 	"net/http"
@@ -11,18 +16,23 @@ import (
 	"os/signal"
 	"path/filepath"
 	"runtime"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"syscall"
 	"time"
 
-	"github.com/pkg/browser"
 	"go.coder.com/flog"
 	"golang.org/x/xerrors"
 )
 
 const codeServerPath = "~/.cache/sshcode/sshcode-server"
 
+// codeServerSocket is the name of the socket code-server listens on in the
+// session's remote socket directory.
+const codeServerSocket = "code-server.sock"
+
 const (
 	sshDirectory               = "~/.ssh"
 	sshDirectoryUnsafeModeMask = 0022
@@ -35,34 +45,219 @@ type options struct {
 	noOpen           bool
 	reuseConnection  bool
 	bindAddr         string
-	remotePort       string
 	sshFlags         string
 	uploadCodeServer string
+	syncSpec         syncSpec
+	scrubber         *scrubber
+	flavor           string
+	pushDir          string
+	syncBackInterval time.Duration
+	forwards         []forward
+	autoForward      bool
+	auth             string
+	share            bool
+	shareReadOnly    bool
+	tls              bool
+	cache            bool
+	startTimeout     time.Duration
+	browser          browserConfig
+	sessionID        string
+	onReady          func(readySession)
 }
 
 func sshCode(host, dir string, o options) error {
-	host, extraSSHFlags, err := parseHost(host)
+	// The host as given is what identifies the workspace across sessions,
+	// even if it resolves to a different address.
+	workspaceHost := host
+
+	t, err := parseHost(host)
 	if err != nil {
 		return xerrors.Errorf("failed to parse host IP: %w", err)
 	}
-	if extraSSHFlags != "" {
-		o.sshFlags = strings.Join([]string{extraSSHFlags, o.sshFlags}, " ")
+	if t.dir != "" {
+		if dir != "" {
+			return xerrors.Errorf("the directory is given both in %v and as the DIR argument", workspaceHost)
+		}
+		dir = t.dir
+	}
+	if dir == "" {
+		dir = "~"
+	}
+	workspace := workspaceHost + " " + dir
+
+	if t.transport != nil {
+		// These are built on rsync and ssh's forwarding.
+		switch {
+		case o.pushDir != "":
+			return xerrors.Errorf("--push needs an SSH host, %v isn't reached over SSH", workspaceHost)
+		case o.syncBack:
+			return xerrors.Errorf("-b needs an SSH host, settings are only copied into %v", workspaceHost)
+		case len(o.forwards) > 0:
+			return xerrors.Errorf("--forward needs an SSH host, %v isn't reached over SSH", workspaceHost)
+		}
+		if _, ok := t.transport.(portForwarder); ok {
+			if _, ok := bindSocketPath(o.bindAddr); ok {
+				return xerrors.Errorf("%v can only be bound to a TCP address", workspaceHost)
+			}
+		}
+	}
+
+	if o.syncSpec == nil {
+		o.syncSpec = defaultSyncSpec()
+	}
+
+	var install vsCodeInstall
+	if !o.skipSync {
+		install, err = findInstall(o.flavor)
+		if err != nil {
+			return xerrors.Errorf("failed to find local VS Code settings: %w", err)
+		}
+		flog.Info("using %v settings from %v", install.flavor, install.configDir)
+	}
+
+	if o.pushDir != "" {
+		o.pushDir, err = resolvePushDir(o.pushDir, dir)
+		if err != nil {
+			return err
+		}
 	}
 
-	o.bindAddr, err = parseBindAddr(o.bindAddr)
+	if o.syncBackInterval > 0 && !o.syncBack {
+		return xerrors.New("--sync-back-interval needs -b")
+	}
+	if o.shareReadOnly && !o.share {
+		return xerrors.New("--share-read-only needs --share")
+	}
+	if o.share {
+		if _, ok := bindSocketPath(o.bindAddr); ok {
+			return xerrors.New("sessions bound to a Unix socket can't be shared")
+		}
+		// The tokens and session cookies give access to a shell on the
+		// target, so they're never sent over the network in the clear.
+		o.tls = true
+		// Shares are reachable from the network unless a host is given.
+		if o.bindAddr == "" || strings.HasPrefix(o.bindAddr, ":") {
+			o.bindAddr = "0.0.0.0" + o.bindAddr
+		}
+	}
+	if o.tls {
+		if _, ok := bindSocketPath(o.bindAddr); ok {
+			return xerrors.New("--tls can't be used with a Unix socket bind address")
+		}
+	}
+
+	o.bindAddr, err = parseBindAddr(o.bindAddr, workspace)
 	if err != nil {
 		return xerrors.Errorf("failed to parse bind address: %w", err)
 	}
 
-	if o.remotePort == "" {
-		o.remotePort, err = randomPort()
+	// code-server listens on a TCP port on the target when the transport
+	// forwards ports, which others on the target, e.g. a pod's other
+	// containers, can reach. It's only protected by a password then.
+	_, forwardsPort := t.transport.(portForwarder)
+	switch o.auth {
+	case "":
+		o.auth = authNone
+		if forwardsPort {
+			o.auth = authPassword
+		}
+	case authNone:
+		if forwardsPort {
+			return xerrors.Errorf("--auth none isn't supported for %v, as code-server listens on a port the rest of the target can reach", workspaceHost)
+		}
+	case authPassword:
+	default:
+		return xerrors.Errorf("unknown auth mode %q, expected %v or %v", o.auth, authNone, authPassword)
+	}
+
+	sessionID := o.sessionID
+	if sessionID == "" {
+		sessionID, err = randomID()
+		if err != nil {
+			return xerrors.Errorf("failed to generate session ID: %w", err)
+		}
+	}
+	socketDir := remoteSocketDir(sessionID)
+
+	err = pruneSessions()
+	if err != nil {
+		flog.Error("failed to remove old sessions: %v", err)
 	}
+	localDir, err := localSessionDir(sessionID)
 	if err != nil {
-		return xerrors.Errorf("failed to find available remote port: %w", err)
+		return xerrors.Errorf("failed to create local session directory: %w", err)
 	}
+	session := sessionInfo{
+		ID:      sessionID,
+		Host:    workspaceHost,
+		Dir:     dir,
+		PID:     os.Getpid(),
+		Started: time.Now(),
+	}
+	defer func() {
+		ended := time.Now()
+		session.Ended = &ended
+		err := writeSession(session)
+		if err != nil {
+			flog.Error("failed to record end of session: %v", err)
+		}
+	}()
 
-	// Check the SSH directory's permissions and warn the user if it is not safe.
-	o.reuseConnection = checkSSHDirectory(sshDirectory, o.reuseConnection)
+	logPath := sessionLogPath(sessionID)
+	logFile, err := os.OpenFile(logPath, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return xerrors.Errorf("failed to create session log: %w", err)
+	}
+	defer logFile.Close()
+
+	// tunnelAddr is where the SSH tunnel is bound. That's the bind address,
+	// unless a local proxy serves the bind address in front of the tunnel, in
+	// which case the tunnel is bound to a socket only the user can access.
+	tunnelAddr := o.bindAddr
+	proxied := o.share || o.tls || o.cache
+	if proxied {
+		tunnelAddr = unixBindPrefix + filepath.Join(localDir, tunnelSocket)
+	}
+
+	// stopStartupSignals hands signals back to the end of the session.
+	stopStartupSignals := func() {}
+	if t.hooks != nil {
+		err = t.hooks.start()
+		if err != nil {
+			return xerrors.Errorf("failed to prepare %v: %w", workspaceHost, err)
+		}
+		var once sync.Once
+		stopHooks := func() {
+			once.Do(func() {
+				err := t.hooks.stop()
+				if err != nil {
+					flog.Error("failed to clean up %v: %v", workspaceHost, err)
+				}
+			})
+		}
+		defer stopHooks()
+		// A signal before the session is up would otherwise end sshcode
+		// without stopping the hooks, e.g. leaving a tunnel running.
+		stopStartupSignals = exitOnSignal(stopHooks)
+		defer stopStartupSignals()
+		if a, ok := t.hooks.(addresser); ok {
+			t.host, t.sshFlags = a.address()
+		}
+	}
+	host = t.destination()
+	if flags := t.flags(); flags != "" {
+		o.sshFlags = strings.Join([]string{flags, o.sshFlags}, " ")
+	}
+	if t.transport == nil {
+		session.SSHHost, session.SSHFlags = host, o.sshFlags
+	}
+
+	if t.transport != nil {
+		o.reuseConnection = false
+	} else {
+		// Check the SSH directory's permissions and warn the user if it is not safe.
+		o.reuseConnection = checkSSHDirectory(sshDirectory, o.reuseConnection)
+	}
 
 	// Start SSH master connection socket. This prevents multiple password prompts from appearing as authentication
 	// only happens on the initial connection.
@@ -78,54 +273,103 @@ func sshCode(host, dir string, o options) error {
 		}
 	}
 
+	// tr runs commands on the target, over the master connection if there
+	// is one.
+	tr := t.transport
+	if tr == nil {
+		tr = sshTransport{sshFlags: o.sshFlags, host: host}
+	}
+
 	// Upload local code-server or download code-server from CI server.
 	if o.uploadCodeServer != "" {
 		flog.Info("uploading local code-server binary...")
-		err = copyCodeServerBinary(o.sshFlags, host, o.uploadCodeServer, codeServerPath)
+		err = validateIsFile(o.uploadCodeServer)
+		if err == nil {
+			err = tr.copyTo(o.uploadCodeServer, codeServerPath)
+		}
 		if err != nil {
 			return xerrors.Errorf("failed to upload local code-server binary to remote server: %w", err)
 		}
 
-		sshCmdStr :=
-			fmt.Sprintf("ssh %v %v 'chmod +x %v'",
-				o.sshFlags, host, codeServerPath,
-			)
-
-		sshCmd := exec.Command("sh", "-l", "-c", sshCmdStr)
-		sshCmd.Stdout = os.Stdout
-		sshCmd.Stderr = os.Stderr
-		err = sshCmd.Run()
+		cmd := tr.command("chmod +x " + codeServerPath)
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+		err = cmd.Run()
 		if err != nil {
-			return xerrors.Errorf("failed to make code-server binary executable:\n---ssh cmd---\n%s: %w",
-				sshCmdStr,
+			return xerrors.Errorf("failed to make code-server binary executable:\n---cmd---\n%s: %w",
+				strings.Join(cmd.Args, " "),
 				err,
 			)
 		}
 	} else {
 		flog.Info("ensuring code-server is updated...")
+		missing, err := missingCommands(tr, "bash", "curl")
+		if err != nil {
+			return err
+		}
+		if len(missing) > 0 {
+			return xerrors.Errorf("%v needs bash and curl to download code-server, but doesn't have %v; "+
+				"install them or pass --upload-code-server", workspaceHost, strings.Join(missing, " or "))
+		}
 		dlScript := downloadScript(codeServerPath)
 
 		// Downloads the latest code-server and allows it to be executed.
-		sshCmdStr := fmt.Sprintf("ssh %v %v '/usr/bin/env bash -l'", o.sshFlags, host)
-		sshCmd := exec.Command("sh", "-l", "-c", sshCmdStr)
-		sshCmd.Stdout = os.Stdout
-		sshCmd.Stderr = os.Stderr
-		sshCmd.Stdin = strings.NewReader(dlScript)
-		err = sshCmd.Run()
+		cmd := tr.command("/usr/bin/env bash -l")
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+		cmd.Stdin = strings.NewReader(dlScript)
+		err = cmd.Run()
 		if err != nil {
-			return xerrors.Errorf("failed to update code-server:\n---ssh cmd---\n%s"+
+			return xerrors.Errorf("failed to update code-server:\n---cmd---\n%s"+
 				"\n---download script---\n%s: %w",
-				sshCmdStr,
+				strings.Join(cmd.Args, " "),
 				dlScript,
 				err,
 			)
 		}
 	}
 
-	if !o.skipSync {
+	var cacheDir string
+	if o.cache {
+		version, err := codeServerVersion(tr)
+		if err != nil {
+			// The proxy still compresses responses.
+			flog.Error("not caching static assets: %v", err)
+		} else {
+			cacheDir = assetCacheDir(version)
+		}
+	}
+
+	backer := &syncBacker{
+		sshFlags:      o.sshFlags,
+		host:          host,
+		workspaceHost: workspaceHost,
+		install:       install,
+		spec:          o.syncSpec,
+		scrubber:      o.scrubber,
+	}
+
+	// Finish the sync-back of a previous session that ended uncleanly before
+	// anything is synced up, as that would overwrite the changes.
+	if t.transport == nil {
+		err = backer.completePending(o.skipSync)
+		if err != nil {
+			return err
+		}
+	}
+
+	if !o.skipSync && t.transport != nil {
+		start := time.Now()
+		flog.Info("copying settings and extensions")
+		err = copySettings(tr, install, o.syncSpec, o.scrubber)
+		if err != nil {
+			return err
+		}
+		flog.Info("copied settings and extensions in %s", time.Since(start))
+	} else if !o.skipSync {
 		start := time.Now()
 		flog.Info("syncing settings")
-		err = syncUserSettings(o.sshFlags, host, false)
+		err = syncUserSettings(o.sshFlags, host, install.configDir, o.syncSpec, o.scrubber, false)
 		if err != nil {
 			return xerrors.Errorf("failed to sync settings: %w", err)
 		}
@@ -133,88 +377,343 @@ func sshCode(host, dir string, o options) error {
 		flog.Info("synced settings in %s", time.Since(start))
 
 		flog.Info("syncing extensions")
-		err = syncExtensions(o.sshFlags, host, false)
+		err = syncExtensions(o.sshFlags, host, install.extensionsDir, false)
 		if err != nil {
 			return xerrors.Errorf("failed to sync extensions: %w", err)
 		}
 		flog.Info("synced extensions in %s", time.Since(start))
 	}
 
+	if o.pushDir != "" {
+		start := time.Now()
+		flog.Info("pushing %v to %v", o.pushDir, dir)
+		err = pushDir(o.sshFlags, host, o.pushDir, dir)
+		if err != nil {
+			return xerrors.Errorf("failed to push %v: %w", o.pushDir, err)
+		}
+		flog.Info("pushed %v in %s", o.pushDir, time.Since(start))
+	}
+
+	syncBack := o.syncBack && !o.skipSync
+	if syncBack {
+		err = markSyncBackPending(workspaceHost)
+		if err != nil {
+			return xerrors.Errorf("failed to record pending sync-back: %w", err)
+		}
+	}
+
 	flog.Info("starting code-server...")
 
-	flog.Info("Tunneling remote port %v to %v", o.remotePort, o.bindAddr)
+	flog.Info("Tunneling remote socket %v to %v", socketDir+"/"+codeServerSocket, o.bindAddr)
+	for _, f := range o.forwards {
+		flog.Info("forwarding remote %v to %v", f.remote, f.localURL())
+	}
 
-	sshCmdStr :=
-		fmt.Sprintf("ssh -tt -q -L %v:localhost:%v %v %v '%v  %v --host 127.0.0.1 --auth none --port=%v'",
-			o.bindAddr, o.remotePort, o.sshFlags, host, codeServerPath, dir, o.remotePort,
-		)
-	// Starts code-server and forwards the remote port.
-	sshCmd := exec.Command("sh", "-l", "-c", sshCmdStr)
-	sshCmd.Stdin = os.Stdin
-	sshCmd.Stdout = os.Stdout
-	sshCmd.Stderr = os.Stderr
-	err = sshCmd.Start()
+	// code-server listens on a socket in a directory only the remote user can
+	// access, which can't collide with other sessions or be reached by other
+	// users like a TCP port on the loopback interface.
+	var password string
+	if o.auth == authPassword {
+		password, err = randomHex(16)
+		if err != nil {
+			return xerrors.Errorf("failed to generate password: %w", err)
+		}
+	}
+	err = prepareSocketDir(tr, socketDir, password)
+	if err != nil {
+		return err
+	}
+
+	if tunnelSocket, ok := bindSocketPath(tunnelAddr); ok {
+		defer os.Remove(tunnelSocket)
+	}
+	socketPath := socketDir + "/" + codeServerSocket
+	listen := "--socket " + socketPath
+	var serverCmd *exec.Cmd
+	if t.transport != nil {
+		// Processes started through the transport keep running when it's
+		// closed, so code-server is found by its listen flags and stopped.
+		killPattern := socketPath
+		if pf, ok := tr.(portForwarder); ok {
+			// The port can't be checked on the target, but a taken one makes
+			// code-server fail to start rather than reach something else.
+			remotePort := strconv.Itoa(20000 + rand.Intn(30000))
+			listen = "--host 127.0.0.1 --port=" + remotePort
+			killPattern = "--port=" + remotePort
+			if _, ok := bindSocketPath(tunnelAddr); ok {
+				// Only the local proxy connects to the tunnel.
+				port, err := randomPort()
+				if err != nil {
+					return xerrors.Errorf("failed to pick a port for the tunnel: %w", err)
+				}
+				tunnelAddr = net.JoinHostPort("127.0.0.1", port)
+			}
+			stopForward, err := pf.forwardPort(remotePort, tunnelAddr, logFile)
+			if err != nil {
+				return err
+			}
+			defer stopForward()
+		} else {
+			// Without ssh to forward the socket, each connection is relayed
+			// by a command on the target.
+			stopRelay, err := serveRelay(tr, socketPath, tunnelAddr)
+			if err != nil {
+				return err
+			}
+			defer stopRelay()
+		}
+		defer func() {
+			out, err := tr.command(killScript(killPattern) + "; rm -rf " + socketDir).CombinedOutput()
+			if err != nil {
+				flog.Error("failed to stop code-server: %s: %v", out, err)
+			}
+		}()
+		serverCmd = tr.command(codeServerCmd(dir, socketDir, listen, remoteLogPath(sessionID), o.auth))
+	} else {
+		tunnelFlags := forwardFlags(o.forwards)
+		if _, ok := bindSocketPath(tunnelAddr); ok {
+			tunnelFlags += " -o StreamLocalBindUnlink=yes"
+		}
+		if o.cache {
+			tunnelFlags += " -o Compression=yes"
+		}
+		sshCmdStr :=
+			fmt.Sprintf("ssh -tt -q -L '%v:%v/%v' %v %v %v '%v'",
+				bindForwardSpec(tunnelAddr), socketDir, codeServerSocket, tunnelFlags, o.sshFlags, host,
+				codeServerCmd(dir, socketDir, listen, remoteLogPath(sessionID), o.auth),
+			)
+		serverCmd = exec.Command("sh", "-l", "-c", sshCmdStr)
+		serverCmd.Stdin = os.Stdin
+	}
+	// Starts code-server and forwards the remote socket. Its output goes to
+	// the session log rather than the terminal.
+	flog.Info("code-server logs are written to %v", logPath)
+	startup := &startupWatcher{}
+	serverCmd.Stdout = io.MultiWriter(logFile, startup)
+	serverCmd.Stderr = io.MultiWriter(os.Stderr, logFile, startup)
+	err = serverCmd.Start()
 	if err != nil {
 		return xerrors.Errorf("failed to start code-server: %w", err)
 	}
+	exited := make(chan error, 1)
+	go func() {
+		exited <- serverCmd.Wait()
+	}()
+
+	if o.startTimeout <= 0 {
+		o.startTimeout = defaultStartTimeout
+	}
+	url, client := bindClient(tunnelAddr, time.Second*3)
+	ctx, cancel := context.WithTimeout(context.Background(), o.startTimeout)
+	err = waitReady(ctx, client, url, exited, startup)
+	cancel()
+	if err != nil {
+		serverCmd.Process.Kill()
+		printTail(startup, logPath)
+		return err
+	}
 
-	url := fmt.Sprintf("http://%s", o.bindAddr)
-	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	ctx, cancel = context.WithCancel(context.Background())
 	defer cancel()
 
-	client := http.Client{
-		Timeout: time.Second * 3,
+	// openQuery is added to URLs opened in the browser.
+	var openQuery string
+	if proxied {
+		proxy, err := newTunnelProxy(tunnelAddr)
+		if err != nil {
+			return xerrors.Errorf("failed to create local proxy: %w", err)
+		}
+		var h http.Handler = proxy
+		if cacheDir != "" {
+			h = &assetCache{next: h, dir: cacheDir}
+		}
+		if o.cache {
+			h = gzipHandler{next: h}
+		}
+
+		scheme := "http"
+		var tlsConfig *tls.Config
+		if o.tls {
+			bindHost, _, _ := net.SplitHostPort(o.bindAddr)
+			hosts := []string{bindHost}
+			if o.share {
+				hosts = append(hosts, shareHost())
+			}
+			tlsConfig, err = sessionTLSConfig(hosts...)
+			if err != nil {
+				return xerrors.Errorf("failed to create TLS certificate: %w", err)
+			}
+			scheme = "https"
+			flog.Info("serving over HTTPS, trust the CA at %v to avoid certificate warnings", localCAPath())
+		}
+
+		if o.share {
+			var readOnly http.Handler
+			if o.shareReadOnly {
+				readOnly = readOnlyView{tr: tr, dir: dir}
+			}
+			auth, err := newShareAuth(h, readOnly)
+			if err != nil {
+				return xerrors.Errorf("failed to generate share tokens: %w", err)
+			}
+			h = auth
+
+			guestAccess := "full"
+			if o.shareReadOnly {
+				guestAccess = "read-only"
+			}
+			flog.Info("sharing session, link for one guest with %v access: %v", guestAccess, shareURL(scheme, o.bindAddr, auth.guestToken))
+			openQuery = "?" + shareTokenParam + "=" + auth.ownerToken
+		}
+		url = localURL(scheme, o.bindAddr)
+
+		stopProxy, err := serveProxy(o.bindAddr, h, tlsConfig)
+		if err != nil {
+			return err
+		}
+		defer stopProxy()
 	}
-	for {
-		if ctx.Err() != nil {
-			return xerrors.Errorf("code-server didn't start in time: %w", ctx.Err())
+
+	if password != "" {
+		flog.Info("code-server password: %v", password)
+	}
+	bindSocket, isUnixBind := bindSocketPath(o.bindAddr)
+	// The login page is also written for detached sessions, which are
+	// opened by the process that started them.
+	var loginPath string
+	if password != "" && !isUnixBind && (!o.noOpen || o.onReady != nil) {
+		loginPath, err = writeLoginPage(url+"/login"+openQuery, password)
+		if err != nil {
+			return xerrors.Errorf("failed to write login page: %w", err)
 		}
-		// Waits for code-server to be available before opening the browser.
-		resp, err := client.Get(url)
+		defer os.Remove(loginPath)
+	}
+	if isUnixBind {
+		// Browsers can't connect to Unix sockets, something else has to.
+		flog.Info("code-server is available at unix socket %v", bindSocket)
+	} else if o.noOpen {
+		flog.Info("code-server is available at %v", url+"/"+openQuery)
+	} else {
+		openURL := url + "/" + openQuery
+		if loginPath != "" {
+			openURL = "file://" + filepath.ToSlash(loginPath)
+		}
+		err = o.browser.open(openURL)
 		if err != nil {
-			continue
+			flog.Error("failed to open browser: %v", err)
 		}
-		resp.Body.Close()
-		break
 	}
 
-	ctx, cancel = context.WithCancel(context.Background())
+	if o.pushDir != "" {
+		go func() {
+			err := watchPushDir(ctx, o.sshFlags, host, o.pushDir, dir)
+			if err != nil {
+				flog.Error("stopped pushing %v: %v", o.pushDir, err)
+			}
+		}()
+	}
 
-	if !o.noOpen {
-		openBrowser(url)
+	if o.autoForward && t.transport == nil {
+		if o.reuseConnection {
+			go newPortWatcher(o, host, socketDir).watch(ctx)
+		} else {
+			flog.Info("not forwarding new remote ports automatically as the SSH connection isn't reused")
+		}
 	}
 
-	go func() {
-		defer cancel()
-		sshCmd.Wait()
-	}()
+	if syncBack && o.syncBackInterval > 0 {
+		go backer.syncBackEvery(ctx, o.syncBackInterval)
+	}
 
-	c := make(chan os.Signal)
-	signal.Notify(c, os.Interrupt)
+	session.URL = url + "/"
+	if _, ok := bindSocketPath(o.bindAddr); ok {
+		session.URL = o.bindAddr
+	}
+	err = writeSession(session)
+	if err != nil {
+		flog.Error("failed to record session: %v", err)
+	}
+	if o.onReady != nil {
+		readyURL := session.URL
+		if openQuery != "" {
+			readyURL += openQuery
+		}
+		o.onReady(readySession{sessionInfo: session, URL: readyURL, Password: password, LoginPage: loginPath})
+	}
+
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
+	stopStartupSignals()
 
 	select {
-	case <-ctx.Done():
+	case err := <-exited:
+		if err != nil {
+			flog.Error("code-server exited unexpectedly: %v", err)
+		} else {
+			flog.Error("code-server exited unexpectedly")
+		}
+		printTail(startup, logPath)
 	case <-c:
 	}
 
 	flog.Info("shutting down")
-	if !o.syncBack || o.skipSync {
+	cancel()
+	for _, f := range o.forwards {
+		if isSocketPath(f.local) {
+			os.Remove(expandPath(f.local))
+		}
+	}
+	if !syncBack {
 		return nil
 	}
 
 	flog.Info("synchronizing VS Code back to local")
 
-	err = syncExtensions(o.sshFlags, host, true)
+	err = backer.syncBack()
 	if err != nil {
-		return xerrors.Errorf("failed to sync extensions back: %w", err)
+		return xerrors.Errorf("sync-back will be retried on the next connection to %v: %w", workspaceHost, err)
 	}
 
-	err = syncUserSettings(o.sshFlags, host, true)
-	if err != nil {
-		return xerrors.Errorf("failed to sync user settings back: %w", err)
+	return clearSyncBackPending(workspaceHost)
+}
+
+// exitOnSignal runs cleanup and exits if sshcode is interrupted or
+// terminated, until the returned function is called.
+func exitOnSignal(cleanup func()) func() {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
+	done := make(chan struct{})
+	go func() {
+		select {
+		case sig := <-c:
+			flog.Info("received %v, cleaning up", sig)
+			cleanup()
+			os.Exit(1)
+		case <-done:
+		}
+	}()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			signal.Stop(c)
+			close(done)
+		})
 	}
+}
 
-	return nil
+// printTail prints the last lines code-server output to explain why it
+// stopped.
+func printTail(out *startupWatcher, logPath string) {
+	tail := out.tail()
+	if len(tail) == 0 {
+		return
+	}
+	fmt.Fprintf(os.Stderr, "---last lines of code-server output, full log at %v---\n", logPath)
+	for _, line := range tail {
+		fmt.Fprintln(os.Stderr, line)
+	}
+	fmt.Fprintln(os.Stderr, "---")
 }
 
 // expandPath returns an expanded version of path.
@@ -235,7 +734,17 @@ func expandPath(path string) string {
 	return filepath.Clean(path)
 }
 
-func parseBindAddr(bindAddr string) (string, error) {
+// unixBindPrefix prefixes bind addresses that are local Unix socket paths.
+const unixBindPrefix = "unix:"
+
+// parseBindAddr parses a bind address in [HOST][:PORT] or unix:PATH syntax.
+// Missing hosts default to the loopback address. Missing ports default to the
+// stable port assigned to portKey, or a random free one if portKey is empty.
+func parseBindAddr(bindAddr string, portKey string) (string, error) {
+	if path, ok := bindSocketPath(bindAddr); ok {
+		return parseBindSocket(path)
+	}
+
 	if !strings.Contains(bindAddr, ":") {
 		bindAddr += ":"
 	}
@@ -249,7 +758,11 @@ func parseBindAddr(bindAddr string) (string, error) {
 		host = "127.0.0.1"
 	}
 
-	if port == "" {
+	switch {
+	case port != "":
+	case portKey != "":
+		port, err = stablePort(portKey, host)
+	default:
 		port, err = randomPort()
 	}
 	if err != nil {
@@ -259,50 +772,75 @@ func parseBindAddr(bindAddr string) (string, error) {
 	return net.JoinHostPort(host, port), nil
 }
 
-func openBrowser(url string) {
-	var openCmd *exec.Cmd
+// parseBindSocket validates the path of a Unix socket bind address and
+// returns the address with the absolute path.
+func parseBindSocket(path string) (string, error) {
+	if path == "" {
+		return "", xerrors.New("missing socket path")
+	}
 
-	const (
-		macPath = "/Applications/Google Chrome.app/Contents/MacOS/Google Chrome"
-		wslPath = "/mnt/c/Program Files (x86)/Google/Chrome/Application/chrome.exe"
-		winPath = "C:/Program Files (x86)/Google/Chrome/Application/chrome.exe"
-	)
+	path, err := filepath.Abs(expandPath(path))
+	if err != nil {
+		return "", err
+	}
 
-	switch {
-	case commandExists("chrome"):
-		openCmd = exec.Command("chrome", chromeOptions(url)...)
-	case commandExists("google-chrome"):
-		openCmd = exec.Command("google-chrome", chromeOptions(url)...)
-	case commandExists("google-chrome-stable"):
-		openCmd = exec.Command("google-chrome-stable", chromeOptions(url)...)
-	case commandExists("chromium"):
-		openCmd = exec.Command("chromium", chromeOptions(url)...)
-	case commandExists("chromium-browser"):
-		openCmd = exec.Command("chromium-browser", chromeOptions(url)...)
-	case pathExists(macPath):
-		openCmd = exec.Command(macPath, chromeOptions(url)...)
-	case pathExists(wslPath):
-		openCmd = exec.Command(wslPath, chromeOptions(url)...)
-	case pathExists(winPath):
-		openCmd = exec.Command(winPath, chromeOptions(url)...)
-	default:
-		err := browser.OpenURL(url)
-		if err != nil {
-			flog.Error("failed to open browser: %v", err)
-		}
-		return
+	// Stale sockets are replaced, but don't clobber anything else.
+	info, err := os.Lstat(path)
+	if err == nil && info.Mode()&os.ModeSocket == 0 {
+		return "", xerrors.Errorf("%v exists and is not a socket", path)
 	}
 
-	// We do not use CombinedOutput because if there is no chrome instance, this will block
-	// and become the parent process instead of using an existing chrome instance.
-	err := openCmd.Start()
-	if err != nil {
-		flog.Error("failed to open browser: %v", err)
+	return unixBindPrefix + path, nil
+}
+
+// bindSocketPath returns the socket path of a unix:PATH bind address.
+func bindSocketPath(bindAddr string) (string, bool) {
+	if !strings.HasPrefix(bindAddr, unixBindPrefix) {
+		return "", false
 	}
+	return strings.TrimPrefix(bindAddr, unixBindPrefix), true
 }
 
-func chromeOptions(url string) []string {
-	return []string{"--app=" + url, "--disable-extensions", "--disable-plugins", "--incognito"}
+// bindForwardSpec returns bindAddr as the local end of an ssh -L forward.
+func bindForwardSpec(bindAddr string) string {
+	if path, ok := bindSocketPath(bindAddr); ok {
+		return path
+	}
+	return bindAddr
+}
+
+// bindClient returns the URL of code-server behind bindAddr and an HTTP
+// client that can reach it, which needs a custom dialer for Unix sockets.
+func bindClient(bindAddr string, timeout time.Duration) (string, *http.Client) {
+	path, ok := bindSocketPath(bindAddr)
+	if !ok {
+		return localURL("http", bindAddr), &http.Client{Timeout: timeout}
+	}
+
+	return "http://localhost", &http.Client{
+		Timeout: timeout,
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", path)
+			},
+		},
+	}
+}
+
+// localURL returns the URL for this machine to reach the TCP bind address
+// over scheme. Browsers refuse unspecified addresses such as 0.0.0.0, and
+// session certificates don't cover them, so the loopback address is used
+// instead.
+func localURL(scheme, bindAddr string) string {
+	host, port, err := net.SplitHostPort(bindAddr)
+	if err != nil {
+		return scheme + "://" + bindAddr
+	}
+	if ip := net.ParseIP(host); host == "" || ip != nil && ip.IsUnspecified() {
+		host = "127.0.0.1"
+	}
+	return scheme + "://" + net.JoinHostPort(host, port)
 }
 
 // Checks if a command exists locally.
@@ -316,6 +854,28 @@ func pathExists(name string) bool {
 	return err == nil
 }
 
+// randomID returns a random hex identifier for a session.
+func randomID() (string, error) {
+	return randomHex(8)
+}
+
+// randomHex returns n cryptographically random bytes, hex encoded.
+func randomHex(n int) (string, error) {
+	b := make([]byte, n)
+	_, err := crand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// remoteSocketDir returns the remote directory holding the sockets of the
+// session with the given ID. It's kept short as socket paths are limited to
+// about 100 bytes.
+func remoteSocketDir(sessionID string) string {
+	return "/tmp/sshcode-" + sessionID
+}
+
 // randomPort picks a random port to start code-server on.
 func randomPort() (string, error) {
 	const (
@@ -435,55 +995,111 @@ func checkSSHMaster(sshMasterCmd *exec.Cmd, sshFlags string, host string) error
 	return xerrors.Errorf("max number of tries exceeded: %d", maxTries)
 }
 
-// copyCodeServerBinary copies a code-server binary from local to remote.
-func copyCodeServerBinary(sshFlags string, host string, localPath string, remotePath string) error {
-	if err := validateIsFile(localPath); err != nil {
+// syncUserSettings syncs the categories of VS Code user data selected by spec
+// for the given direction. If scrub is not nil, secrets are held back from
+// uploaded files and restored into files synced back.
+func syncUserSettings(sshFlags string, host string, localConfDir string, spec syncSpec, scrub *scrubber, back bool) error {
+	err := ensureDir(localConfDir)
+	if err != nil {
 		return err
 	}
 
+	var remoteSettingsDir = "~/.local/share/code-server/User/"
+	if runtime.GOOS == "windows" {
+		remoteSettingsDir = ".local/share/code-server/User/"
+	}
 	var (
-		src  = localPath
-		dest = host + ":" + remotePath
+		src     = localConfDir + "/"
+		dest    = host + ":" + remoteSettingsDir
+		filters = spec.rsyncFilters(back)
 	)
 
-	return rsync(src, dest, sshFlags)
-}
+	if scrub == nil {
+		if back {
+			dest, src = src, dest
+		}
+		// Append "/" to have rsync copy the contents of the dir.
+		return rsync(src, dest, sshFlags, filters...)
+	}
 
-func syncUserSettings(sshFlags string, host string, back bool) error {
-	localConfDir, err := configDir()
+	// Files containing secrets are found in the local directory either way:
+	// before upload to hold them back, and before syncing back to restore them.
+	secrets, unscanned, err := scrub.findSecrets(localConfDir, spec, back)
 	if err != nil {
-		return err
+		return xerrors.Errorf("failed to scan settings for secrets: %w", err)
+	}
+	files := make([]string, 0, len(secrets))
+	for rel := range secrets {
+		files = append(files, rel)
 	}
+	sort.Strings(files)
+	// Files that can't be scrubbed are left alone both ways unless the user
+	// opted in to uploading them, so the remote copy doesn't overwrite them
+	// either.
+	filters = append(scrub.heldBack(unscanned), filters...)
 
-	err = ensureDir(localConfDir)
+	if back {
+		return syncUserSettingsBack(sshFlags, dest, localConfDir, filters, scrub, files)
+	}
+	defer scrub.warnUnscanned(unscanned)
+
+	if len(files) == 0 {
+		return rsync(src, dest, sshFlags, filters...)
+	}
+
+	// Upload everything except the files containing secrets, then upload
+	// scrubbed copies of those.
+	excludes := make([]string, len(files))
+	for i, rel := range files {
+		excludes[i] = "- /" + rel
+	}
+	err = rsync(src, dest, sshFlags, append(excludes, filters...)...)
 	if err != nil {
 		return err
 	}
 
-	var remoteSettingsDir = "~/.local/share/code-server/User/"
-	if runtime.GOOS == "windows" {
-		remoteSettingsDir = ".local/share/code-server/User/"
+	stageDir, err := ioutil.TempDir("", "sshcode-settings")
+	if err != nil {
+		return err
 	}
-	var (
-		src  = localConfDir + "/"
-		dest = host + ":" + remoteSettingsDir
-	)
+	defer os.RemoveAll(stageDir)
 
-	if back {
-		dest, src = src, dest
+	err = scrub.stageScrubbed(localConfDir, stageDir, files)
+	if err != nil {
+		return xerrors.Errorf("failed to scrub secrets: %w", err)
+	}
+	err = rsync(stageDir+"/", dest, sshFlags, includeFilters(files)...)
+	if err != nil {
+		return err
 	}
 
-	// Append "/" to have rsync copy the contents of the dir.
-	return rsync(src, dest, sshFlags, "workspaceStorage", "logs", "CachedData")
+	for _, rel := range files {
+		flog.Info("warning: held back secrets in %v: %v", rel, strings.Join(secrets[rel], ", "))
+	}
+	return nil
 }
 
-func syncExtensions(sshFlags string, host string, back bool) error {
-	localExtensionsDir, err := extensionsDir()
+// syncUserSettingsBack syncs VS Code user data from src on the remote host to
+// localConfDir, restoring the secrets that were scrubbed from files on upload.
+// The files are backed up on disk first, so their secrets survive sshcode
+// stopping before they're restored, and are restored on the next sync-back.
+func syncUserSettingsBack(sshFlags, src, localConfDir string, filters []string, scrub *scrubber, files []string) error {
+	backupDir := secretsBackupDir(localConfDir)
+	err := backupSecrets(localConfDir, backupDir, files)
+	if err != nil {
+		return xerrors.Errorf("failed to back up files containing secrets: %w", err)
+	}
+
+	err = rsync(src, localConfDir+"/", sshFlags, filters...)
 	if err != nil {
 		return err
 	}
 
-	err = ensureDir(localExtensionsDir)
+	return scrub.restoreSecrets(localConfDir, backupDir)
+}
+
+func syncExtensions(sshFlags string, host string, localExtensionsDir string, back bool) error {
+	err := ensureDir(localExtensionsDir)
 	if err != nil {
 		return err
 	}
@@ -504,20 +1120,34 @@ func syncExtensions(sshFlags string, host string, back bool) error {
 	return rsync(src, dest, sshFlags)
 }
 
-func rsync(src string, dest string, sshFlags string, excludePaths ...string) error {
-	excludeFlags := make([]string, len(excludePaths))
-	for i, path := range excludePaths {
-		excludeFlags[i] = "--exclude=" + path
+// rsync copies src to dest, deleting anything in dest that isn't in src.
+// filters are rsync filter rules, e.g. "- logs".
+func rsync(src string, dest string, sshFlags string, filters ...string) error {
+	return runRsync(src, dest, sshFlags, true, filters...)
+}
+
+// rsyncUpdate copies src to dest like rsync, but leaves anything in dest that
+// isn't in src.
+func rsyncUpdate(src string, dest string, sshFlags string, filters ...string) error {
+	return runRsync(src, dest, sshFlags, false, filters...)
+}
+
+func runRsync(src string, dest string, sshFlags string, mirror bool, filters ...string) error {
+	var flags []string
+	for _, rule := range filters {
+		flags = append(flags, "--filter="+rule)
+	}
+	if mirror {
+		// This is more unsafe, but it's obnoxious having to enter VS Code
+		// locally in order to properly delete an extension.
+		flags = append(flags, "--delete")
 	}
 
-	cmd := exec.Command("rsync", append(excludeFlags, "-azvr",
+	cmd := exec.Command("rsync", append(flags, "-azvr",
 		"-e", "ssh "+sshFlags,
 		// Only update newer directories, and sync times
 		// to keep things simple.
 		"-u", "--times",
-		// This is more unsafe, but it's obnoxious having to enter VS Code
-		// locally in order to properly delete an extension.
-		"--delete",
 		"--copy-unsafe-links",
 		"-zz",
 		src, dest,
@@ -533,29 +1163,45 @@ func rsync(src string, dest string, sshFlags string, excludePaths ...string) err
 	return nil
 }
 
+// missingCommands returns those of the commands that aren't on the target's
+// PATH.
+func missingCommands(tr transport, commands ...string) ([]string, error) {
+	script := fmt.Sprintf(`for c in %v; do command -v $c >/dev/null 2>&1 || echo $c; done`, strings.Join(commands, " "))
+	out, err := tr.command(script).Output()
+	if err != nil {
+		return nil, xerrors.Errorf("failed to check for %v: %v: %w", strings.Join(commands, ", "), commandStderr(err), err)
+	}
+	return strings.Fields(string(out)), nil
+}
+
+// downloadScript downloads the latest code-server to codeServerPath. The new
+// release is moved into place rather than written over the old one, so
+// code-servers other sessions are running from it are left alone.
 func downloadScript(codeServerPath string) string {
 	return fmt.Sprintf(
 		`set -euxo pipefail || exit 1
 
 [ "$(uname -m)" != "x86_64" ] && echo "Unsupported server architecture $(uname -m). code-server only has releases for x86_64 systems." && exit 1
-pkill -f %v || true
 mkdir -p $HOME/.local/share/code-server %v
 cd %v
-curlflags="-o latest-linux"
+tmp=latest-linux.$$
+rm -f $tmp
+curlflags="-o $tmp"
 if [ -f latest-linux ]; then
 	curlflags="$curlflags -z latest-linux"
 fi
 curl $curlflags https://codesrv-ci.cdr.sh/latest-linux
-[ -f %v ] && rm %v
-ln latest-linux %v
+if [ -s $tmp ]; then
+	chmod +x $tmp
+	mv -f $tmp latest-linux
+fi
+rm -f $tmp
+ln -f latest-linux %v
 chmod +x %v`,
-		codeServerPath,
 		filepath.ToSlash(filepath.Dir(codeServerPath)),
 		filepath.ToSlash(filepath.Dir(codeServerPath)),
 		codeServerPath,
 		codeServerPath,
-		codeServerPath,
-		codeServerPath,
 	)
 }
 
@@ -590,45 +1236,6 @@ func validateIsFile(path string) error {
 	return nil
 }
 
-// parseHost parses the host argument. If 'gcp:' is prefixed to the
-// host then a lookup is done using gcloud to determine the external IP and any
-// additional SSH arguments that should be used for ssh commands. Otherwise, host
-// is returned.
-func parseHost(host string) (parsedHost string, additionalFlags string, err error) {
-	host = strings.TrimSpace(host)
-	switch {
-	case strings.HasPrefix(host, "gcp:"):
-		instance := strings.TrimPrefix(host, "gcp:")
-		return parseGCPSSHCmd(instance)
-	default:
-		return host, "", nil
-	}
-}
-
-// parseGCPSSHCmd parses the IP address and flags used by 'gcloud' when
-// ssh'ing to an instance.
-func parseGCPSSHCmd(instance string) (ip, sshFlags string, err error) {
-	dryRunCmd := fmt.Sprintf("gcloud compute ssh --dry-run %v", instance)
-
-	out, err := exec.Command("sh", "-l", "-c", dryRunCmd).CombinedOutput()
-	if err != nil {
-		return "", "", xerrors.Errorf("%s: %w", out, err)
-	}
-
-	toks := strings.Split(string(out), " ")
-	if len(toks) < 2 {
-		return "", "", xerrors.Errorf("unexpected output for '%v' command, %s", dryRunCmd, out)
-	}
-
-	// Slice off the '/usr/bin/ssh' prefix and the '<user>@<ip>' suffix.
-	sshFlags = strings.Join(toks[1:len(toks)-1], " ")
-
-	// E.g. foo@1.2.3.4.
-	userIP := toks[len(toks)-1]
-
-	return strings.TrimSpace(userIP), sshFlags, nil
-}
-
 // gitbashWindowsDir strips a the msys2 install directory from the beginning of
 // the path. On msys2, if a user provides `/workspace` sshcode will receive
 // `C:/msys64/workspace` which won't work on the remote host.
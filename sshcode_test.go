@@ -4,10 +4,13 @@ import (
 	"context"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"net"
 	"net/http"
+	"os"
 	"os/exec"
 	"path/filepath"
+	"runtime"
 	"strconv"
 	"sync"
 	"testing"
@@ -28,24 +31,19 @@ func TestSSHCode(t *testing.T) {
 	localPort := randomPortExclude(t, sshPort)
 	require.NotEmpty(t, localPort)
 
-	remotePort := randomPortExclude(t, sshPort, localPort)
-	require.NotEmpty(t, remotePort)
-
 	var wg sync.WaitGroup
 	wg.Add(1)
 	go func() {
 		defer wg.Done()
 		err := sshCode("foo@127.0.0.1", "", options{
-			sshFlags:   testSSHArgs(sshPort),
-			bindAddr:   net.JoinHostPort("127.0.0.1", localPort),
-			remotePort: remotePort,
-			noOpen:     true,
+			sshFlags: testSSHArgs(sshPort),
+			bindAddr: net.JoinHostPort("127.0.0.1", localPort),
+			noOpen:   true,
 		})
 		require.NoError(t, err)
 	}()
 
 	waitForSSHCode(t, localPort, time.Second*30)
-	waitForSSHCode(t, remotePort, time.Second*30)
 
 	// Typically we'd do an os.Stat call here but the os package doesn't expand '~'
 	out, err := exec.Command("sh", "-l", "-c", "stat "+codeServerPath).CombinedOutput()
@@ -57,6 +55,45 @@ func TestSSHCode(t *testing.T) {
 	wg.Wait()
 }
 
+func TestParseBindAddr(t *testing.T) {
+	addr, err := parseBindAddr("0.0.0.0:8080", "")
+	require.NoError(t, err)
+	require.Equal(t, "0.0.0.0:8080", addr)
+
+	addr, err = parseBindAddr("", "")
+	require.NoError(t, err)
+	host, _, err := net.SplitHostPort(addr)
+	require.NoError(t, err)
+	require.Equal(t, "127.0.0.1", host)
+
+	dir, err := ioutil.TempDir("", "sshcode-bind")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	sock := filepath.Join(dir, "code.sock")
+	addr, err = parseBindAddr("unix:"+sock, "")
+	require.NoError(t, err)
+	path, ok := bindSocketPath(addr)
+	require.True(t, ok)
+	require.Equal(t, sock, path)
+
+	// Regular files aren't replaced by the socket.
+	require.NoError(t, ioutil.WriteFile(sock, nil, 0600))
+	_, err = parseBindAddr("unix:"+sock, "")
+	require.Error(t, err)
+
+	_, err = parseBindAddr("unix:", "")
+	require.Error(t, err)
+}
+
+func TestLocalURL(t *testing.T) {
+	require.Equal(t, "https://127.0.0.1:8080", localURL("https", "0.0.0.0:8080"))
+	require.Equal(t, "http://127.0.0.1:8080", localURL("http", "[::]:8080"))
+	require.Equal(t, "http://127.0.0.1:8080", localURL("http", ":8080"))
+	require.Equal(t, "http://192.168.1.5:8080", localURL("http", "192.168.1.5:8080"))
+	require.Equal(t, "http://[::1]:8080", localURL("http", "[::1]:8080"))
+}
+
 // trassh is an incomplete, local, insecure ssh server
 // used for the purpose of testing the implementation without
 // requiring the user to have their own remote server.
@@ -105,6 +142,22 @@ func trassh(t *testing.T, port string) io.Closer {
 						}
 
 						go handleDirectTCPIP(ch, &req, t)
+					case "direct-streamlocal@openssh.com":
+						var req directStreamLocalReq
+
+						err := ssh.Unmarshal(c.ExtraData(), &req)
+						if err != nil {
+							t.Logf("failed to unmarshal streamlocal data: %v", err)
+							continue
+						}
+
+						ch, _, err := c.Accept()
+						if err != nil {
+							c.Reject(ssh.ConnectionFailed, fmt.Sprintf("unable to accept channel: %v", err))
+							continue
+						}
+
+						go handleDirectStreamLocal(ch, &req, t)
 					case "session":
 						ch, inReqs, err := c.Accept()
 						if err != nil {
@@ -127,11 +180,19 @@ func trassh(t *testing.T, port string) io.Closer {
 }
 
 func handleDirectTCPIP(ch ssh.Channel, req *directTCPIPReq, t *testing.T) {
-	defer ch.Close()
-
 	dstAddr := net.JoinHostPort(req.Host, strconv.Itoa(int(req.Port)))
+	proxyChannel(ch, "tcp", dstAddr)
+}
+
+func handleDirectStreamLocal(ch ssh.Channel, req *directStreamLocalReq, t *testing.T) {
+	proxyChannel(ch, "unix", req.SocketPath)
+}
+
+// proxyChannel copies data between ch and a connection to addr.
+func proxyChannel(ch ssh.Channel, network, addr string) {
+	defer ch.Close()
 
-	conn, err := net.Dial("tcp", dstAddr)
+	conn, err := net.Dial(network, addr)
 	if err != nil {
 		return
 	}
@@ -172,6 +233,15 @@ type directTCPIPReq struct {
 	OrigPort uint32
 }
 
+// directStreamLocalReq describes the extra data sent in a
+// direct-streamlocal@openssh.com request containing the remote socket path.
+type directStreamLocalReq struct {
+	SocketPath string
+
+	Reserved0 string
+	Reserved1 uint32
+}
+
 // exitStatus describes an 'exit-status' message
 // returned after a request.
 type exitStatus struct {
@@ -314,3 +384,38 @@ func randomPortExclude(t *testing.T, exludedPorts ...string) string {
 
 	return ""
 }
+
+// exitOnSignalHelperEnv makes TestExitOnSignal run exitOnSignal in the test
+// binary and signal itself, with the cleanup creating the file it names.
+const exitOnSignalHelperEnv = "SSHCODE_TEST_EXIT_ON_SIGNAL"
+
+func TestExitOnSignal(t *testing.T) {
+	if path := os.Getenv(exitOnSignalHelperEnv); path != "" {
+		exitOnSignal(func() { ioutil.WriteFile(path, nil, 0600) })
+		p, _ := os.FindProcess(os.Getpid())
+		p.Signal(os.Interrupt)
+		time.Sleep(5 * time.Second)
+		return
+	}
+	if runtime.GOOS == "windows" {
+		t.Skip("can't interrupt itself on Windows")
+	}
+
+	dir, err := ioutil.TempDir("", "sshcode-signal")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "cleaned-up")
+
+	cmd := exec.Command(os.Args[0], "-test.run=^TestExitOnSignal$")
+	cmd.Env = append(os.Environ(), exitOnSignalHelperEnv+"="+path)
+	err = cmd.Run()
+	exitErr, ok := err.(*exec.ExitError)
+	require.True(t, ok, "%v", err)
+	require.Equal(t, 1, exitErr.ExitCode())
+	require.True(t, pathExists(path))
+
+	// Nothing happens once it's stopped.
+	stop := exitOnSignal(func() { t.Fatal("cleanup ran") })
+	stop()
+	stop()
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"encoding/json"
+	"hash/fnv"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"go.coder.com/flog"
+)
+
+// Stable ports are assigned from this range, which is below the ephemeral
+// port range of most systems.
+const (
+	stablePortMin = 20000
+	stablePortMax = 29999
+)
+
+// stablePortsPath returns the file that records the local port assigned to
+// each host and directory.
+func stablePortsPath() string {
+	return filepath.Join(stateDir(), "ports.json")
+}
+
+// stablePort returns the local port assigned to key, so the editor is reached
+// at the same URL across sessions and the browser keeps its per-origin state.
+// New keys are assigned a free port derived from their hash. If the assigned
+// port is taken, a random port is used for this session only.
+func stablePort(key, host string) (string, error) {
+	ports := loadStablePorts()
+
+	if port, ok := ports[key]; ok {
+		if portFree(host, port) {
+			return strconv.Itoa(port), nil
+		}
+		flog.Info("port %v assigned to %v is taken, using a random port", port, key)
+		return randomPort()
+	}
+
+	assigned := make(map[int]bool, len(ports))
+	for _, port := range ports {
+		assigned[port] = true
+	}
+
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	const size = stablePortMax - stablePortMin + 1
+	start := int(h.Sum32() % size)
+	for i := 0; i < size; i++ {
+		port := stablePortMin + (start+i)%size
+		if assigned[port] || !portFree(host, port) {
+			continue
+		}
+
+		ports[key] = port
+		err := saveStablePorts(ports)
+		if err != nil {
+			flog.Error("failed to save port assignment: %v", err)
+		}
+		return strconv.Itoa(port), nil
+	}
+	return randomPort()
+}
+
+func portFree(host string, port int) bool {
+	l, err := net.Listen("tcp", net.JoinHostPort(host, strconv.Itoa(port)))
+	if err != nil {
+		return false
+	}
+	l.Close()
+	return true
+}
+
+// loadStablePorts reads the port assignments. Unreadable assignments are
+// treated as empty since they only affect which port is picked.
+func loadStablePorts() map[string]int {
+	ports := make(map[string]int)
+	b, err := ioutil.ReadFile(stablePortsPath())
+	if err != nil {
+		return ports
+	}
+	err = json.Unmarshal(b, &ports)
+	if err != nil {
+		flog.Error("failed to parse %v: %v", stablePortsPath(), err)
+		return make(map[string]int)
+	}
+	return ports
+}
+
+func saveStablePorts(ports map[string]int) error {
+	b, err := json.MarshalIndent(ports, "", "\t")
+	if err != nil {
+		return err
+	}
+
+	path := stablePortsPath()
+	err = os.MkdirAll(filepath.Dir(path), 0700)
+	if err != nil {
+		return err
+	}
+
+	return writeFileAtomic(path, b)
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestStablePort(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sshcode-state")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	old, ok := os.LookupEnv("XDG_STATE_HOME")
+	if ok {
+		defer os.Setenv("XDG_STATE_HOME", old)
+	} else {
+		defer os.Unsetenv("XDG_STATE_HOME")
+	}
+	os.Setenv("XDG_STATE_HOME", dir)
+
+	port, err := stablePort("dev ~/src", "127.0.0.1")
+	require.NoError(t, err)
+
+	again, err := stablePort("dev ~/src", "127.0.0.1")
+	require.NoError(t, err)
+	require.Equal(t, port, again)
+
+	other, err := stablePort("dev ~/other", "127.0.0.1")
+	require.NoError(t, err)
+	require.NotEqual(t, port, other)
+
+	// A taken port falls back to another one without losing the assignment.
+	l, err := net.Listen("tcp", net.JoinHostPort("127.0.0.1", port))
+	require.NoError(t, err)
+	taken, err := stablePort("dev ~/src", "127.0.0.1")
+	require.NoError(t, err)
+	require.NotEqual(t, port, taken)
+	l.Close()
+
+	again, err = stablePort("dev ~/src", "127.0.0.1")
+	require.NoError(t, err)
+	require.Equal(t, port, again)
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// stateDir returns the local directory sshcode keeps state in between runs.
+func stateDir() string {
+	base := os.Getenv("XDG_STATE_HOME")
+	if base == "" {
+		base = os.ExpandEnv("$HOME/.local/state")
+	}
+	return filepath.Join(base, "sshcode")
+}
+
+// localSessionDir creates and returns a directory only the user can access
+// for local state of the session with the given ID.
+func localSessionDir(sessionID string) (string, error) {
+	dir := filepath.Join(sessionsDir(), sessionID)
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		return "", err
+	}
+	// MkdirAll doesn't change the mode of existing parents.
+	return dir, os.Chmod(dir, 0700)
+}
+
+// writeFileAtomic writes b to name through a temporary file, so concurrent
+// readers never see a partially written file.
+func writeFileAtomic(name string, b []byte) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(name), filepath.Base(name))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	_, err = tmp.Write(b)
+	if err != nil {
+		tmp.Close()
+		return err
+	}
+	err = tmp.Close()
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), name)
+}
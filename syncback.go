@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"go.coder.com/flog"
+	"golang.org/x/xerrors"
+)
+
+// syncBacker syncs VS Code extensions and settings from a remote host back to
+// local. It is safe for concurrent use.
+type syncBacker struct {
+	sshFlags string
+	host     string
+	// workspaceHost is the host as given, which pending sync-backs are
+	// recorded against as host may resolve differently next time.
+	workspaceHost string
+	install       vsCodeInstall
+	spec          syncSpec
+	scrubber      *scrubber
+
+	mu sync.Mutex
+}
+
+// syncBack syncs extensions and settings back to local.
+func (s *syncBacker) syncBack() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	err := syncExtensions(s.sshFlags, s.host, s.install.extensionsDir, true)
+	if err != nil {
+		return xerrors.Errorf("failed to sync extensions back: %w", err)
+	}
+
+	err = syncUserSettings(s.sshFlags, s.host, s.install.configDir, s.spec, s.scrubber, true)
+	if err != nil {
+		return xerrors.Errorf("failed to sync user settings back: %w", err)
+	}
+	return nil
+}
+
+// completePending finishes the sync-back of a previous session against the
+// workspace host that ended before syncing back, unless sync is skipped.
+func (s *syncBacker) completePending(skipSync bool) error {
+	started, ok := syncBackPending(s.workspaceHost)
+	if !ok {
+		return nil
+	}
+	if skipSync {
+		flog.Info("warning: the session started at %v didn't sync back, skipping it as sync is disabled", started)
+		return nil
+	}
+
+	flog.Info("completing sync-back of the session started at %v", started)
+	err := s.syncBack()
+	if err != nil {
+		return xerrors.Errorf("failed to complete pending sync-back, pass --skipsync to connect without syncing: %w", err)
+	}
+	err = clearSyncBackPending(s.workspaceHost)
+	if err != nil {
+		return xerrors.Errorf("failed to clear pending sync-back: %w", err)
+	}
+	return nil
+}
+
+// syncBackEvery syncs back every interval until ctx is canceled. Failures are
+// logged and retried on the next tick.
+func (s *syncBacker) syncBackEvery(ctx context.Context, interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			start := time.Now()
+			err := s.syncBack()
+			if err != nil {
+				flog.Error("periodic sync-back failed: %v", err)
+				continue
+			}
+			flog.Info("synced VS Code back to local in %s", time.Since(start))
+		}
+	}
+}
+
+// pendingSyncBackPath returns the path of the marker recording that a
+// sync-back from host hasn't completed.
+func pendingSyncBackPath(host string) string {
+	return filepath.Join(stateDir(), "pending-sync-back", url.PathEscape(host))
+}
+
+// markSyncBackPending records that changes on host need to be synced back.
+// The marker is removed by clearSyncBackPending once they are.
+func markSyncBackPending(host string) error {
+	path := pendingSyncBackPath(host)
+	err := os.MkdirAll(filepath.Dir(path), 0700)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, []byte(time.Now().Format(time.RFC3339)+"\n"), 0600)
+}
+
+// clearSyncBackPending removes the marker written by markSyncBackPending.
+func clearSyncBackPending(host string) error {
+	err := os.Remove(pendingSyncBackPath(host))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// syncBackPending reports whether a previous session against host ended
+// before syncing back, and when it started.
+func syncBackPending(host string) (string, bool) {
+	b, err := ioutil.ReadFile(pendingSyncBackPath(host))
+	if err != nil {
+		return "", false
+	}
+	return strings.TrimSpace(string(b)), true
+}
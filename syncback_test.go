@@ -0,0 +1,75 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// fakeRsync records the source and destination it's run with, and fails if
+// the fail file next to it exists.
+const fakeRsync = `#!/bin/sh
+dir=$(dirname "$0")
+[ -f "$dir/fail" ] && exit 1
+for last; do :; done
+echo "$last" >> "$dir/args"
+`
+
+func TestSyncBacker(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sshcode-syncback")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	err = ioutil.WriteFile(filepath.Join(dir, "rsync"), []byte(fakeRsync), 0755)
+	require.NoError(t, err)
+	path, stateHome := os.Getenv("PATH"), os.Getenv("XDG_STATE_HOME")
+	defer func() {
+		os.Setenv("PATH", path)
+		os.Setenv("XDG_STATE_HOME", stateHome)
+	}()
+	os.Setenv("PATH", dir+string(os.PathListSeparator)+path)
+	os.Setenv("XDG_STATE_HOME", dir)
+
+	install := vsCodeInstall{
+		configDir:     filepath.Join(dir, "User"),
+		extensionsDir: filepath.Join(dir, "extensions"),
+	}
+	backer := &syncBacker{host: "kyle@10.0.0.2", workspaceHost: "dev", install: install, spec: defaultSyncSpec()}
+	readArgs := func() []string {
+		b, _ := ioutil.ReadFile(filepath.Join(dir, "args"))
+		os.Remove(filepath.Join(dir, "args"))
+		return strings.Fields(string(b))
+	}
+
+	// Nothing is pending.
+	require.NoError(t, backer.completePending(false))
+	require.Empty(t, readArgs())
+
+	require.NoError(t, markSyncBackPending("dev"))
+	_, ok := syncBackPending("dev")
+	require.True(t, ok)
+	_, ok = syncBackPending("other")
+	require.False(t, ok)
+
+	// Skipping sync leaves the sync-back pending.
+	require.NoError(t, backer.completePending(true))
+	require.Empty(t, readArgs())
+	_, ok = syncBackPending("dev")
+	require.True(t, ok)
+
+	// A failed sync-back stays pending.
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "fail"), nil, 0600))
+	require.Error(t, backer.completePending(false))
+	_, ok = syncBackPending("dev")
+	require.True(t, ok)
+
+	require.NoError(t, os.Remove(filepath.Join(dir, "fail")))
+	require.NoError(t, backer.completePending(false))
+	require.Equal(t, []string{install.extensionsDir + "/", install.configDir + "/"}, readArgs())
+	_, ok = syncBackPending("dev")
+	require.False(t, ok)
+}
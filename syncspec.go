@@ -0,0 +1,194 @@
+package main
+
+import (
+	"sort"
+	"strings"
+
+	"golang.org/x/xerrors"
+)
+
+// syncDirection describes which way a category of VS Code user data is synced.
+type syncDirection string
+
+const (
+	// syncBoth syncs to the remote host on start and back on termination.
+	syncBoth syncDirection = "both"
+	// syncUp only syncs to the remote host.
+	syncUp syncDirection = "up"
+	// syncDown only syncs back from the remote host.
+	syncDown syncDirection = "down"
+	// syncNone never syncs.
+	syncNone syncDirection = "none"
+)
+
+// allows reports whether d syncs in the given direction.
+func (d syncDirection) allows(back bool) bool {
+	switch d {
+	case syncBoth:
+		return true
+	case syncUp:
+		return !back
+	case syncDown:
+		return back
+	default:
+		return false
+	}
+}
+
+// Sync categories. Extension globalStorage can also be configured per
+// extension with a "globalStorage/<extension-id>" key.
+const (
+	syncSettings      = "settings"
+	syncKeybindings   = "keybindings"
+	syncSnippets      = "snippets"
+	syncGlobalStorage = "globalStorage"
+	syncProfiles      = "profiles"
+	// syncOther covers the rest of the user directory, such as tasks.json
+	// and locale.json, apart from neverSyncedDirs.
+	syncOther = "other"
+)
+
+// syncCategoryPaths maps sync categories to rsync patterns relative to the
+// VS Code user directory. The order is the order rules are emitted in.
+var syncCategoryPaths = []struct {
+	category string
+	pattern  string
+}{
+	{syncSettings, "/settings.json"},
+	{syncKeybindings, "/keybindings.json"},
+	{syncSnippets, "/snippets/***"},
+	{syncGlobalStorage, "/globalStorage/***"},
+	{syncProfiles, "/profiles/***"},
+}
+
+// neverSyncedDirs are the top-level directories of the VS Code user directory
+// that hold per-machine state and are never synced.
+var neverSyncedDirs = []string{"workspaceStorage", "logs", "CachedData"}
+
+// syncSpec maps sync categories to the direction they're synced in.
+// Anything in the VS Code user directory that isn't covered by a category is
+// synced as the other category, apart from neverSyncedDirs.
+type syncSpec map[string]syncDirection
+
+// defaultSyncSpec returns the spec used when the user doesn't override it.
+func defaultSyncSpec() syncSpec {
+	return syncSpec{
+		syncSettings:      syncBoth,
+		syncKeybindings:   syncBoth,
+		syncSnippets:      syncBoth,
+		syncGlobalStorage: syncBoth,
+		syncProfiles:      syncBoth,
+		syncOther:         syncBoth,
+	}
+}
+
+// apply overrides entries in s with the CATEGORY=DIRECTION pairs in overrides.
+func (s syncSpec) apply(overrides map[string]string) error {
+	for category, dir := range overrides {
+		if !validSyncCategory(category) {
+			return xerrors.Errorf("unknown sync category %q", category)
+		}
+
+		d := syncDirection(strings.ToLower(dir))
+		switch d {
+		case syncBoth, syncUp, syncDown, syncNone:
+		default:
+			return xerrors.Errorf("invalid sync direction %q for %v, expected one of both, up, down or none", dir, category)
+		}
+		s[category] = d
+	}
+	return nil
+}
+
+func validSyncCategory(category string) bool {
+	if ext := strings.TrimPrefix(category, syncGlobalStorage+"/"); ext != category {
+		return ext != "" && !strings.Contains(ext, "/")
+	}
+	if category == syncOther {
+		return true
+	}
+	for _, c := range syncCategoryPaths {
+		if c.category == category {
+			return true
+		}
+	}
+	return false
+}
+
+// rsyncFilters returns the rsync filter rules that select the categories
+// synced in the given direction. rsync uses the first rule that matches, so
+// per-extension rules are emitted before the globalStorage category.
+func (s syncSpec) rsyncFilters(back bool) []string {
+	var exts []string
+	for category := range s {
+		if strings.HasPrefix(category, syncGlobalStorage+"/") {
+			exts = append(exts, category)
+		}
+	}
+	sort.Strings(exts)
+
+	var rules []string
+	for _, ext := range exts {
+		if s[ext].allows(back) {
+			rules = append(rules, "+ /"+syncGlobalStorage+"/", "+ /"+ext+"/***")
+		} else {
+			rules = append(rules, "- /"+ext+"/")
+		}
+	}
+	for _, c := range syncCategoryPaths {
+		if s[c.category].allows(back) {
+			rules = append(rules, "+ "+c.pattern)
+		} else {
+			rules = append(rules, "- "+c.pattern)
+		}
+	}
+	for _, dir := range neverSyncedDirs {
+		rules = append(rules, "- /"+dir+"/")
+	}
+	if s[syncOther].allows(back) {
+		return rules
+	}
+	return append(rules, "- *")
+}
+
+// covers reports whether the file at rel, a slash separated path relative to
+// the VS Code user directory, is synced in the given direction. It mirrors the
+// rules returned by rsyncFilters.
+func (s syncSpec) covers(rel string, back bool) bool {
+	parts := strings.SplitN(rel, "/", 3)
+	if len(parts) > 2 && parts[0] == syncGlobalStorage {
+		if d, ok := s[syncGlobalStorage+"/"+parts[1]]; ok {
+			return d.allows(back)
+		}
+	}
+
+	for _, c := range syncCategoryPaths {
+		prefix := strings.TrimSuffix(strings.TrimPrefix(c.pattern, "/"), "***")
+		if rel == prefix || (strings.HasSuffix(prefix, "/") && strings.HasPrefix(rel, prefix)) {
+			return s[c.category].allows(back)
+		}
+	}
+	for _, dir := range neverSyncedDirs {
+		if rel == dir || strings.HasPrefix(rel, dir+"/") {
+			return false
+		}
+	}
+	return s[syncOther].allows(back)
+}
+
+// coversDir reports whether anything in the top-level directory rel of the
+// VS Code user directory is synced in the given direction.
+func (s syncSpec) coversDir(rel string, back bool) bool {
+	if s.covers(rel+"/", back) {
+		return true
+	}
+	if rel != syncGlobalStorage {
+		return false
+	}
+	for category, d := range s {
+		if strings.HasPrefix(category, syncGlobalStorage+"/") && d.allows(back) {
+			return true
+		}
+	}
+	return false
+}
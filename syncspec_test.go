@@ -0,0 +1,75 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSyncSpecFilters(t *testing.T) {
+	spec := defaultSyncSpec()
+	err := spec.apply(map[string]string{
+		"keybindings":                 "up",
+		"profiles":                    "none",
+		"globalStorage/vscodevim.vim": "down",
+	})
+	require.NoError(t, err)
+
+	require.Equal(t, []string{
+		"- /globalStorage/vscodevim.vim/",
+		"+ /settings.json",
+		"+ /keybindings.json",
+		"+ /snippets/***",
+		"+ /globalStorage/***",
+		"- /profiles/***",
+		"- /workspaceStorage/",
+		"- /logs/",
+		"- /CachedData/",
+	}, spec.rsyncFilters(false))
+
+	require.Equal(t, []string{
+		"+ /globalStorage/",
+		"+ /globalStorage/vscodevim.vim/***",
+		"+ /settings.json",
+		"- /keybindings.json",
+		"+ /snippets/***",
+		"+ /globalStorage/***",
+		"- /profiles/***",
+		"- /workspaceStorage/",
+		"- /logs/",
+		"- /CachedData/",
+	}, spec.rsyncFilters(true))
+
+	err = spec.apply(map[string]string{"other": "none"})
+	require.NoError(t, err)
+	require.Equal(t, "- *", spec.rsyncFilters(false)[len(spec.rsyncFilters(false))-1])
+}
+
+func TestSyncSpecCovers(t *testing.T) {
+	spec := defaultSyncSpec()
+	err := spec.apply(map[string]string{"snippets": "none"})
+	require.NoError(t, err)
+
+	require.True(t, spec.covers("settings.json", false))
+	require.True(t, spec.covers("tasks.json", false))
+	require.True(t, spec.covers("locale.json", true))
+	require.False(t, spec.covers("snippets/go.json", false))
+	require.False(t, spec.covers("workspaceStorage/abc/state.vscdb", false))
+	require.False(t, spec.coversDir("logs", true))
+	require.True(t, spec.coversDir("History", false))
+
+	err = spec.apply(map[string]string{"other": "up"})
+	require.NoError(t, err)
+	require.True(t, spec.covers("tasks.json", false))
+	require.False(t, spec.covers("tasks.json", true))
+}
+
+func TestSyncSpecApplyInvalid(t *testing.T) {
+	for _, overrides := range []map[string]string{
+		{"workspaceStorage": "both"},
+		{"globalStorage/": "both"},
+		{"settings": "sideways"},
+	} {
+		require.Error(t, defaultSyncSpec().apply(overrides), "%v", overrides)
+	}
+}
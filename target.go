@@ -0,0 +1,152 @@
+package main
+
+import (
+	"net/url"
+	"regexp"
+	"strings"
+
+	"golang.org/x/xerrors"
+)
+
+// target is where a session runs, as parsed from the HOST argument.
+type target struct {
+	user      string
+	host      string
+	port      string
+	jumpHosts []string
+	// dir is the directory given in the target, if any.
+	dir string
+	// sshFlags are additional flags needed to reach host, e.g. those
+	// gcloud uses.
+	sshFlags string
+	// hooks are run around the session if set.
+	hooks sessionHooks
+	// transport reaches the target instead of ssh if set.
+	transport transport
+}
+
+// destination returns the destination passed to ssh.
+func (t target) destination() string {
+	if t.user == "" {
+		return t.host
+	}
+	return t.user + "@" + t.host
+}
+
+// validate checks that the target's user, host, port, jump hosts and
+// directory can be passed to the shell unquoted. sshFlags are built by
+// providers, which quote them as needed.
+func (t target) validate() error {
+	if t.host == "" {
+		return xerrors.New("missing host")
+	}
+	for _, arg := range append([]string{t.user, t.host, t.port}, t.jumpHosts...) {
+		if arg != "" && !safeSSHArg.MatchString(strings.Replace(arg, "@", "", 1)) {
+			return xerrors.Errorf("invalid characters in %q", arg)
+		}
+	}
+	if t.dir != "" && !safePath.MatchString(t.dir) {
+		return xerrors.Errorf("invalid characters in directory %q", t.dir)
+	}
+	return nil
+}
+
+// validateSSHFlags checks that each of the space separated flags can be passed
+// to the shell unquoted, for flags that don't come from sshcode.
+func validateSSHFlags(flags string) error {
+	for _, flag := range strings.Fields(flags) {
+		if !safePath.MatchString(flag) {
+			return xerrors.Errorf("invalid characters in ssh flag %q", flag)
+		}
+	}
+	return nil
+}
+
+// flags returns the ssh flags needed to reach the target.
+func (t target) flags() string {
+	var flags []string
+	if t.port != "" {
+		flags = append(flags, "-p "+t.port)
+	}
+	if len(t.jumpHosts) > 0 {
+		flags = append(flags, "-J "+strings.Join(t.jumpHosts, ","))
+	}
+	if t.sshFlags != "" {
+		flags = append(flags, t.sshFlags)
+	}
+	return strings.Join(flags, " ")
+}
+
+// safeSSHArg matches host names, users and ports that can be passed to the
+// shell without quoting.
+var safeSSHArg = regexp.MustCompile(`^[A-Za-z0-9._%:\[\]-]+$`)
+
+// safePath matches paths, and ssh flags and their values such as
+// -oKey=VALUE, that can be passed to the shell without quoting.
+var safePath = regexp.MustCompile(`^[A-Za-z0-9._%:@=,+~/-]+$`)
+
+// shellQuote quotes s as a single word for the shell.
+func shellQuote(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
+
+// shellQuotePath quotes the path p for the shell, leaving a leading ~ for it
+// to expand.
+func shellQuotePath(p string) string {
+	switch {
+	case p == "~":
+		return p
+	case strings.HasPrefix(p, "~/"):
+		return "~/" + shellQuote(p[2:])
+	}
+	return shellQuote(p)
+}
+
+// parseSSHURI parses a target in ssh://[USER@]HOST[:PORT][/DIR][?jump=HOST,...]
+// syntax.
+func parseSSHURI(s string) (target, error) {
+	u, err := url.Parse(s)
+	if err != nil {
+		return target{}, err
+	}
+	if u.Hostname() == "" {
+		return target{}, xerrors.Errorf("missing host in %q", s)
+	}
+
+	t := target{
+		user: u.User.Username(),
+		host: u.Hostname(),
+		port: u.Port(),
+		dir:  uriDir(u.Path),
+	}
+	if strings.Contains(t.host, ":") {
+		// IPv6 addresses are written bare on the ssh command line.
+		t.host = strings.Trim(t.host, "[]")
+	}
+	for _, jumps := range u.Query()["jump"] {
+		for _, jump := range strings.Split(jumps, ",") {
+			if jump != "" {
+				t.jumpHosts = append(t.jumpHosts, jump)
+			}
+		}
+	}
+
+	err = t.validate()
+	if err != nil {
+		return target{}, err
+	}
+	return t, nil
+}
+
+// uriDir returns the directory for the path of a URI. Paths are absolute,
+// except those starting with /~, which are relative to the home directory.
+func uriDir(path string) string {
+	switch {
+	case path == "" || path == "/":
+		return ""
+	case path == "/~" || strings.HasPrefix(path, "/~/"):
+		return strings.TrimSuffix(path[1:], "/")
+	default:
+		return path
+	}
+}
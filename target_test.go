@@ -0,0 +1,59 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseHost(t *testing.T) {
+	tcs := []struct {
+		host        string
+		destination string
+		flags       string
+		dir         string
+		wantErr     bool
+	}{
+		{host: "kyle@dev.kwc.io", destination: "kyle@dev.kwc.io"},
+		{host: " 10.0.0.5 ", destination: "10.0.0.5"},
+		{host: "ssh://dev.kwc.io", destination: "dev.kwc.io"},
+		{host: "ssh://kyle@dev.kwc.io:2222/srv/app", destination: "kyle@dev.kwc.io", flags: "-p 2222", dir: "/srv/app"},
+		{host: "ssh://kyle@dev.kwc.io/~/projects/sourcegraph/", destination: "kyle@dev.kwc.io", dir: "~/projects/sourcegraph"},
+		{host: "ssh://dev.kwc.io/~", destination: "dev.kwc.io", dir: "~"},
+		{host: "ssh://[::1]:2222", destination: "::1", flags: "-p 2222"},
+		{host: "ssh://dev?jump=bastion,kyle@inner:2200", destination: "dev", flags: "-J bastion,kyle@inner:2200"},
+		{host: "ssh://dev?jump=a&jump=b", destination: "dev", flags: "-J a,b"},
+		{host: "ssh:///srv/app", wantErr: true},
+		{host: "ssh://dev?jump=a%60rm%60", wantErr: true},
+		{host: "ssh://ky'le@dev", wantErr: true},
+		{host: "ssh://dev/srv/a%20b", wantErr: true},
+		{host: "ssh://dev/srv/$(id)", wantErr: true},
+		{host: "gcp://project/zone", wantErr: true},
+		{host: "gcp://project/zone/in$tance", wantErr: true},
+	}
+
+	for _, tc := range tcs {
+		t.Run(tc.host, func(t *testing.T) {
+			target, err := parseHost(tc.host)
+			if tc.wantErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tc.destination, target.destination())
+			require.Equal(t, tc.flags, target.flags())
+			require.Equal(t, tc.dir, target.dir)
+		})
+	}
+}
+
+func TestParseGCPURI(t *testing.T) {
+	args, dir, err := parseGCPURI("gcp://my-project/us-central1-a/dev/~/src")
+	require.NoError(t, err)
+	require.Equal(t, []string{"--project", "my-project", "--zone", "us-central1-a", "dev"}, args)
+	require.Equal(t, "~/src", dir)
+
+	_, dir, err = parseGCPURI("gcp://my-project/us-central1-a/dev")
+	require.NoError(t, err)
+	require.Equal(t, "", dir)
+}
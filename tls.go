@@ -0,0 +1,211 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	crand "crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+
+	"go.coder.com/flog"
+	"golang.org/x/xerrors"
+)
+
+// localCADir returns the directory the local CA is kept in.
+func localCADir() string {
+	return filepath.Join(stateDir(), "tls")
+}
+
+// localCAPath returns the path of the local CA certificate, which users add
+// to their browser's trust store.
+func localCAPath() string {
+	return filepath.Join(localCADir(), "ca.pem")
+}
+
+// caPermittedIPRanges limits what the local CA can issue certificates for to
+// loopback and private addresses, so its key can't be used to impersonate
+// other sites.
+var caPermittedIPRanges = []string{
+	"127.0.0.0/8",
+	"10.0.0.0/8",
+	"172.16.0.0/12",
+	"192.168.0.0/16",
+	"169.254.0.0/16",
+	"::1/128",
+	"fc00::/7",
+	"fe80::/10",
+}
+
+// loadLocalCA loads the local CA, generating it on first use.
+func loadLocalCA() (*x509.Certificate, *ecdsa.PrivateKey, error) {
+	keyPath := filepath.Join(localCADir(), "ca-key.pem")
+
+	certPEM, certErr := ioutil.ReadFile(localCAPath())
+	keyPEM, keyErr := ioutil.ReadFile(keyPath)
+	if os.IsNotExist(certErr) && os.IsNotExist(keyErr) {
+		return generateLocalCA(keyPath)
+	}
+	if certErr != nil {
+		return nil, nil, certErr
+	}
+	if keyErr != nil {
+		return nil, nil, keyErr
+	}
+
+	cert, err := parsePEM(certPEM, "CERTIFICATE", func(b []byte) (interface{}, error) {
+		return x509.ParseCertificate(b)
+	})
+	if err != nil {
+		return nil, nil, xerrors.Errorf("failed to parse %v: %w", localCAPath(), err)
+	}
+	key, err := parsePEM(keyPEM, "EC PRIVATE KEY", func(b []byte) (interface{}, error) {
+		return x509.ParseECPrivateKey(b)
+	})
+	if err != nil {
+		return nil, nil, xerrors.Errorf("failed to parse %v: %w", keyPath, err)
+	}
+	return cert.(*x509.Certificate), key.(*ecdsa.PrivateKey), nil
+}
+
+func parsePEM(b []byte, typ string, parse func([]byte) (interface{}, error)) (interface{}, error) {
+	block, _ := pem.Decode(b)
+	if block == nil || block.Type != typ {
+		return nil, xerrors.Errorf("no %v PEM block found", typ)
+	}
+	return parse(block.Bytes)
+}
+
+func generateLocalCA(keyPath string) (*x509.Certificate, *ecdsa.PrivateKey, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), crand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var permitted []*net.IPNet
+	for _, cidr := range caPermittedIPRanges {
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, nil, err
+		}
+		permitted = append(permitted, ipNet)
+	}
+
+	serial, err := randomSerial()
+	if err != nil {
+		return nil, nil, err
+	}
+	hostname, _ := os.Hostname()
+	tmpl := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: "sshcode local CA (" + hostname + ")"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().AddDate(10, 0, 0),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		MaxPathLenZero:        true,
+		PermittedDNSDomains:   []string{"localhost"},
+		PermittedIPRanges:     permitted,
+	}
+	der, err := x509.CreateCertificate(crand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	err = os.MkdirAll(localCADir(), 0700)
+	if err != nil {
+		return nil, nil, err
+	}
+	err = ioutil.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600)
+	if err != nil {
+		return nil, nil, err
+	}
+	err = ioutil.WriteFile(localCAPath(), pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644)
+	if err != nil {
+		return nil, nil, err
+	}
+	return cert, key, nil
+}
+
+// sessionTLSConfig returns a TLS config with a certificate for this session
+// signed by the local CA, valid for localhost and the IP addresses in hosts.
+// Host names other than localhost are left out since the CA can't vouch for
+// them.
+func sessionTLSConfig(hosts ...string) (*tls.Config, error) {
+	ca, caKey, err := loadLocalCA()
+	if err != nil {
+		return nil, xerrors.Errorf("failed to load local CA: %w", err)
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), crand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	serial, err := randomSerial()
+	if err != nil {
+		return nil, err
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: "sshcode session"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().AddDate(0, 0, 30),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback},
+	}
+	for _, h := range hosts {
+		ip := net.ParseIP(h)
+		if ip != nil && !ip.IsUnspecified() && !ip.IsLoopback() {
+			tmpl.IPAddresses = append(tmpl.IPAddresses, ip)
+		}
+	}
+
+	der, err := x509.CreateCertificate(crand.Reader, tmpl, ca, &key.PublicKey, caKey)
+	if err != nil {
+		return nil, xerrors.Errorf("failed to issue session certificate: %w", err)
+	}
+	return &tls.Config{
+		Certificates: []tls.Certificate{{
+			Certificate: [][]byte{der, ca.Raw},
+			PrivateKey:  key,
+		}},
+		MinVersion: tls.VersionTLS12,
+	}, nil
+}
+
+// printLocalCA prints the local CA certificate for users to trust, along
+// with where it's stored.
+func printLocalCA() {
+	_, _, err := loadLocalCA()
+	if err != nil {
+		flog.Fatal("failed to load local CA: %v", err)
+	}
+	b, err := ioutil.ReadFile(localCAPath())
+	if err != nil {
+		flog.Fatal("failed to read local CA: %v", err)
+	}
+	flog.Info("local CA certificate is stored at %v", localCAPath())
+	os.Stdout.Write(b)
+}
+
+func randomSerial() (*big.Int, error) {
+	return crand.Int(crand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+}
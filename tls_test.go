@@ -0,0 +1,50 @@
+package main
+
+import (
+	"crypto/x509"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSessionTLSConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sshcode-state")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	old, ok := os.LookupEnv("XDG_STATE_HOME")
+	if ok {
+		defer os.Setenv("XDG_STATE_HOME", old)
+	} else {
+		defer os.Unsetenv("XDG_STATE_HOME")
+	}
+	os.Setenv("XDG_STATE_HOME", dir)
+
+	conf, err := sessionTLSConfig("0.0.0.0", "192.168.1.5")
+	require.NoError(t, err)
+
+	ca, _, err := loadLocalCA()
+	require.NoError(t, err)
+	info, err := os.Stat(localCAPath())
+	require.NoError(t, err)
+	require.False(t, info.IsDir())
+
+	// The CA is reused by later sessions.
+	again, _, err := loadLocalCA()
+	require.NoError(t, err)
+	require.Equal(t, ca.Raw, again.Raw)
+
+	leaf, err := x509.ParseCertificate(conf.Certificates[0].Certificate[0])
+	require.NoError(t, err)
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca)
+	for _, name := range []string{"localhost", "127.0.0.1", "192.168.1.5"} {
+		_, err = leaf.Verify(x509.VerifyOptions{DNSName: name, Roots: roots})
+		require.NoError(t, err, name)
+	}
+	_, err = leaf.Verify(x509.VerifyOptions{DNSName: "192.168.1.6", Roots: roots})
+	require.Error(t, err)
+}
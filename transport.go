@@ -0,0 +1,268 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"go.coder.com/flog"
+	"golang.org/x/xerrors"
+)
+
+// transport runs commands on and copies files to a target. Hosts are reached
+// with sshTransport, but providers can set another on targets that aren't
+// reached over ssh, such as containers.
+type transport interface {
+	// command returns a command that runs the shell script on the target.
+	command(script string) *exec.Cmd
+	// copyTo copies the local file src to dst on the target, or the
+	// contents of the local directory src into the directory dst.
+	copyTo(src, dst string) error
+}
+
+// portForwarder is implemented by transports that forward TCP ports on the
+// target themselves. code-server listens on a port on the target's loopback
+// interface for them, rather than on a socket that connections are relayed
+// to.
+type portForwarder interface {
+	// forwardPort forwards localAddr, a host:port bind address, to the port
+	// on the target, writing its output to out. The returned function stops
+	// it.
+	forwardPort(port, localAddr string, out io.Writer) (func(), error)
+}
+
+// sshTransport reaches a host over ssh, and copies files with rsync.
+type sshTransport struct {
+	sshFlags string
+	host     string
+}
+
+func (s sshTransport) command(script string) *exec.Cmd {
+	return exec.Command("sh", "-l", "-c", fmt.Sprintf("ssh %v %v %v", s.sshFlags, s.host, shellQuote(script)))
+}
+
+func (s sshTransport) copyTo(src, dst string) error {
+	info, err := os.Stat(src)
+	if err != nil {
+		return err
+	}
+	if info.IsDir() {
+		// Append "/" to have rsync copy the contents of the dir.
+		src, dst = src+"/", dst+"/"
+	}
+	return rsync(src, s.host+":"+dst, s.sshFlags)
+}
+
+// relayScript connects its stdin and stdout to the Unix socket at path.
+func relayScript(path string) string {
+	return fmt.Sprintf(`if command -v socat >/dev/null 2>&1; then exec socat - UNIX-CONNECT:%[1]v; `+
+		`elif command -v nc >/dev/null 2>&1; then exec nc -U %[1]v; `+
+		`else echo "socat or nc is needed to reach code-server" >&2; exit 1; fi`,
+		path,
+	)
+}
+
+// serveRelay forwards connections to tunnelAddr, a bind address, to the Unix
+// socket at socketPath on the target by running relayScript with tr for each.
+// It's how code-server is reached on targets that can't forward sockets like
+// ssh -L. The returned function stops it.
+func serveRelay(tr transport, socketPath, tunnelAddr string) (func(), error) {
+	network, addr := "tcp", tunnelAddr
+	if path, ok := bindSocketPath(tunnelAddr); ok {
+		network, addr = "unix", path
+		os.Remove(path)
+	}
+	l, err := net.Listen(network, addr)
+	if err != nil {
+		return nil, xerrors.Errorf("failed to listen on %v: %w", tunnelAddr, err)
+	}
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				cmd := tr.command(relayScript(socketPath))
+				cmd.Stdin = conn
+				cmd.Stdout = conn
+				var stderr strings.Builder
+				cmd.Stderr = &stderr
+				err := cmd.Run()
+				// code-server closes idle connections, which isn't worth
+				// reporting.
+				if err != nil && stderr.Len() > 0 {
+					flog.Error("relay to code-server failed: %v: %v", strings.TrimSpace(stderr.String()), err)
+				}
+			}()
+		}
+	}()
+	return func() { l.Close() }, nil
+}
+
+// killScript kills the processes whose command line contains pattern, other
+// than itself. Processes started through a container's exec keep running
+// when the connection closes, unlike those started over ssh -tt.
+func killScript(pattern string) string {
+	return fmt.Sprintf(`for p in /proc/[0-9]*; do pid=${p#/proc/}; `+
+		`[ "$pid" != $$ ] && grep -q -- "%v" $p/cmdline 2>/dev/null && kill $pid 2>/dev/null; done; true`,
+		pattern,
+	)
+}
+
+// copySettings copies the VS Code user data selected by spec and the
+// extensions in install to the target with tr, for transports that can't
+// rsync. Secrets are held back as they are when syncing over ssh.
+func copySettings(tr transport, install vsCodeInstall, spec syncSpec, scrub *scrubber) error {
+	stageDir, err := ioutil.TempDir("", "sshcode-settings")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(stageDir)
+
+	err = stageSettings(install.configDir, stageDir, spec, scrub)
+	if err != nil {
+		return xerrors.Errorf("failed to collect settings: %w", err)
+	}
+	err = tr.copyTo(stageDir, "~/.local/share/code-server/User")
+	if err != nil {
+		return xerrors.Errorf("failed to copy settings: %w", err)
+	}
+
+	if !pathExists(install.extensionsDir) {
+		return nil
+	}
+	err = copyExtensions(tr, install.extensionsDir, "~/.local/share/code-server/extensions")
+	if err != nil {
+		return xerrors.Errorf("failed to copy extensions: %w", err)
+	}
+	return nil
+}
+
+// copyExtensions makes the extensions in remoteDir match those in localDir.
+// Extension directories are named after the extension and its version, so
+// only the ones missing from remoteDir are copied, and the ones that aren't
+// in localDir are removed like they are by rsync --delete. Other files, such
+// as the list of extensions, are always copied.
+func copyExtensions(tr transport, localDir, remoteDir string) error {
+	infos, err := ioutil.ReadDir(localDir)
+	if err != nil {
+		return err
+	}
+	out, err := tr.command(fmt.Sprintf(`ls -A1 %v 2>/dev/null; true`, remoteDir)).Output()
+	if err != nil {
+		return xerrors.Errorf("failed to list extensions: %v: %w", commandStderr(err), err)
+	}
+	remote := make(map[string]bool)
+	for _, name := range strings.Split(string(out), "\n") {
+		if name != "" {
+			remote[name] = true
+		}
+	}
+	if len(remote) == 0 {
+		return tr.copyTo(localDir, remoteDir)
+	}
+
+	local := make(map[string]bool)
+	for _, info := range infos {
+		local[info.Name()] = true
+		if info.IsDir() && remote[info.Name()] {
+			continue
+		}
+		err = tr.copyTo(filepath.Join(localDir, info.Name()), remoteDir+"/"+info.Name())
+		if err != nil {
+			return err
+		}
+	}
+
+	var removed []string
+	for name := range remote {
+		if !local[name] {
+			removed = append(removed, shellQuote(name))
+		}
+	}
+	if len(removed) > 0 {
+		out, err = tr.command(fmt.Sprintf("cd %v && rm -rf %v", remoteDir, strings.Join(removed, " "))).CombinedOutput()
+		if err != nil {
+			return xerrors.Errorf("failed to remove old extensions: %s: %w", out, err)
+		}
+	}
+	return nil
+}
+
+// stageSettings copies the files in the VS Code user directory dir that spec
+// syncs up to stageDir, scrubbing secrets from them and holding back those
+// that can't be scrubbed if scrub isn't nil.
+func stageSettings(dir, stageDir string, spec syncSpec, scrub *scrubber) error {
+	return filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+
+		if info.IsDir() {
+			if path != dir && !strings.Contains(rel, "/") && !spec.coversDir(rel, false) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !info.Mode().IsRegular() || !spec.covers(rel, false) {
+			return nil
+		}
+		if scrub != nil && isUnscanned(rel) {
+			scrub.warnUnscanned([]string{rel})
+			if !scrub.uploadUnscanned {
+				return nil
+			}
+		}
+
+		dest := filepath.Join(stageDir, filepath.FromSlash(rel))
+		err = os.MkdirAll(filepath.Dir(dest), 0700)
+		if err != nil {
+			return err
+		}
+		if scrub != nil && filepath.Ext(path) == ".json" {
+			b, err := ioutil.ReadFile(path)
+			if err != nil {
+				return err
+			}
+			b, keys := scrub.scrub(b)
+			if len(keys) > 0 {
+				flog.Info("warning: held back secrets in %v: %v", rel, strings.Join(keys, ", "))
+			}
+			return ioutil.WriteFile(dest, b, 0600)
+		}
+		return copyFile(path, dest, info.Mode())
+	})
+}
+
+// copyFile copies the file src to dst, which is created with mode.
+func copyFile(src, dst string, mode os.FileMode) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode.Perm())
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, in)
+	if err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
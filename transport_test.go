@@ -0,0 +1,164 @@
+package main
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// echoTransport runs cat for every command, so relays echo what they're sent.
+type echoTransport struct{}
+
+func (echoTransport) command(string) *exec.Cmd {
+	return exec.Command("cat")
+}
+
+func (echoTransport) copyTo(src, dst string) error {
+	return nil
+}
+
+func TestServeRelay(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sshcode-relay")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "tunnel.sock")
+	stop, err := serveRelay(echoTransport{}, "/tmp/code-server.sock", unixBindPrefix+path)
+	require.NoError(t, err)
+	defer stop()
+
+	for i := 0; i < 2; i++ {
+		conn, err := net.Dial("unix", path)
+		require.NoError(t, err)
+		_, err = conn.Write([]byte("hello"))
+		require.NoError(t, err)
+		b := make([]byte, 5)
+		_, err = io.ReadFull(conn, b)
+		require.NoError(t, err)
+		require.Equal(t, "hello", string(b))
+		conn.Close()
+	}
+}
+
+func TestStageSettings(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sshcode-stage")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	userDir := filepath.Join(dir, "User")
+	stageDir := filepath.Join(dir, "stage")
+	files := map[string]string{
+		"settings.json":                    `{"github.copilot.advanced": {"authToken": "ghu_abc"}}`,
+		"keybindings.json":                 `[]`,
+		"snippets/go.json":                 `{}`,
+		"workspaceStorage/abc/state.vscdb": "state",
+		"globalStorage/state.vscdb":        "state",
+		"globalStorage/ext.id/auth.json":   `{"token": "abc"}`,
+	}
+	for rel, content := range files {
+		path := filepath.Join(userDir, filepath.FromSlash(rel))
+		require.NoError(t, os.MkdirAll(filepath.Dir(path), 0700))
+		require.NoError(t, ioutil.WriteFile(path, []byte(content), 0600))
+	}
+
+	spec := defaultSyncSpec()
+	spec[syncKeybindings] = syncNone
+	err = stageSettings(userDir, stageDir, spec, newScrubber(nil))
+	require.NoError(t, err)
+
+	settings, err := ioutil.ReadFile(filepath.Join(stageDir, "settings.json"))
+	require.NoError(t, err)
+	require.NotContains(t, string(settings), "ghu_abc")
+	require.True(t, pathExists(filepath.Join(stageDir, "snippets", "go.json")))
+	require.False(t, pathExists(filepath.Join(stageDir, "keybindings.json")))
+	require.False(t, pathExists(filepath.Join(stageDir, "workspaceStorage")))
+	require.True(t, pathExists(filepath.Join(stageDir, "globalStorage", "ext.id", "auth.json")))
+	// Files that can't be scrubbed are held back unless the user opts in.
+	require.False(t, pathExists(filepath.Join(stageDir, "globalStorage", "state.vscdb")))
+
+	require.NoError(t, os.RemoveAll(stageDir))
+	scrub := newScrubber(nil)
+	scrub.uploadUnscanned = true
+	require.NoError(t, stageSettings(userDir, stageDir, spec, scrub))
+	require.True(t, pathExists(filepath.Join(stageDir, "globalStorage", "state.vscdb")))
+}
+
+// copyTransport is a localTransport that records what it copies and copies
+// it with cp.
+type copyTransport struct {
+	localTransport
+	copied []string
+}
+
+func (c *copyTransport) copyTo(src, dst string) error {
+	c.copied = append(c.copied, filepath.Base(src))
+	dst = c.home + strings.TrimPrefix(dst, "~")
+	if info, err := os.Stat(src); err == nil && info.IsDir() {
+		src += "/."
+	}
+	err := os.MkdirAll(filepath.Dir(dst), 0700)
+	if err != nil {
+		return err
+	}
+	return exec.Command("cp", "-R", src, dst).Run()
+}
+
+func TestCopyExtensions(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sshcode-extensions")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	localDir := filepath.Join(dir, "local")
+	home := filepath.Join(dir, "home")
+	remoteDir := filepath.Join(home, "extensions")
+	for _, path := range []string{"a.go-1.0/package.json", "b.py-2.0/package.json", "extensions.json"} {
+		path = filepath.Join(localDir, path)
+		require.NoError(t, os.MkdirAll(filepath.Dir(path), 0700))
+		require.NoError(t, ioutil.WriteFile(path, []byte("{}"), 0600))
+	}
+
+	// The first session copies the whole directory.
+	tr := &copyTransport{localTransport: localTransport{home: home}}
+	require.NoError(t, copyExtensions(tr, localDir, "~/extensions"))
+	require.Equal(t, []string{"local"}, tr.copied)
+
+	// Later ones copy what changed and remove uninstalled extensions.
+	require.NoError(t, os.RemoveAll(filepath.Join(localDir, "b.py-2.0")))
+	require.NoError(t, os.MkdirAll(filepath.Join(localDir, "b.py-2.1"), 0700))
+	require.NoError(t, os.MkdirAll(filepath.Join(remoteDir, "it's-0.1"), 0700))
+	tr.copied = nil
+	require.NoError(t, copyExtensions(tr, localDir, "~/extensions"))
+	require.Equal(t, []string{"b.py-2.1", "extensions.json"}, tr.copied)
+
+	infos, err := ioutil.ReadDir(remoteDir)
+	require.NoError(t, err)
+	var names []string
+	for _, info := range infos {
+		names = append(names, info.Name())
+	}
+	require.Equal(t, []string{"a.go-1.0", "b.py-2.1", "extensions.json"}, names)
+}
+
+func TestMissingCommands(t *testing.T) {
+	missing, err := missingCommands(localTransport{home: os.Getenv("HOME")}, "sh", "sshcode-missing-a", "sshcode-missing-b")
+	require.NoError(t, err)
+	require.Equal(t, []string{"sshcode-missing-a", "sshcode-missing-b"}, missing)
+}
+
+func TestSSHTransportQuoting(t *testing.T) {
+	// Scripts reach the host intact, including the quotes readOnlyView
+	// puts around paths.
+	script := `cat -- './it'\''s here'`
+	cmd := sshTransport{sshFlags: "-p 2222", host: "dev"}.command(script)
+	arg := strings.TrimPrefix(cmd.Args[3], "ssh -p 2222 dev ")
+	out, err := exec.Command("sh", "-c", "printf %s "+arg).Output()
+	require.NoError(t, err)
+	require.Equal(t, script, string(out))
+}